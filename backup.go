@@ -18,16 +18,22 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/cheggaaa/pb/v3"
@@ -46,11 +52,70 @@ var backupFlags = []cli.Flag{
 		Name:  "tags",
 		Usage: "add additional tags for the backup",
 	},
+	cli.StringSliceFlag{
+		Name:  "tag",
+		Usage: "add an additional tag of 'key=value' form for the backup, can be repeated",
+	},
 	cli.Int64Flag{
 		Name:  "part-size",
 		Value: 64 * humanize.MiByte,
 		Usage: "configure upload part size per transfer",
 	},
+	cli.IntFlag{
+		Name:  "concurrency",
+		Value: defaultProfileConcurrency,
+		Usage: "number of profiles to export and upload in parallel",
+	},
+	cli.StringFlag{
+		Name:  "lxc-export-args",
+		Usage: "extra arguments for 'lxc export', one of " + strings.Join(exportArgsAllowed, ", "),
+	},
+	cli.BoolFlag{
+		Name:  "no-cleanup-on-error",
+		Usage: "keep staged files when the backup fails, for debugging",
+	},
+	cli.IntFlag{
+		Name:  "compress-level",
+		Usage: "compression level passed to 'lxc export', e.g. 1 (fastest) to 9 (smallest) for gzip",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print what would be backed up and where, without exporting or uploading",
+	},
+	cli.BoolFlag{
+		Name:  "instance-only",
+		Usage: "exclude snapshots of the instance for a smaller backup",
+	},
+	cli.StringFlag{
+		Name:  "compression",
+		Value: "gzip",
+		Usage: "compression of the instance export, 'gzip' or 'none' for an uncompressed '.tar' on fast links",
+	},
+	cli.BoolFlag{
+		Name:  "compress-on-upload",
+		Usage: "gzip profiles before uploading them, for bandwidth constrained links",
+	},
+	cli.BoolFlag{
+		Name:  "volumes",
+		Usage: "also backup the custom storage volumes attached to the instance",
+	},
+	cli.StringFlag{
+		Name:  "storage-class",
+		Usage: "storage class of the backup objects, e.g. 'REDUCED_REDUNDANCY' or a MinIO tier",
+	},
+	cli.StringFlag{
+		Name:  "retain-until",
+		Usage: "protect the backup from deletion until this RFC3339 date with object lock, e.g. '2030-01-02T15:04:05Z'",
+	},
+	cli.StringFlag{
+		Name:  "retention-mode",
+		Value: "governance",
+		Usage: "object lock retention mode of '--retain-until', 'governance' or 'compliance'",
+	},
+	cli.BoolFlag{
+		Name:  "legal-hold",
+		Usage: "protect the backup from deletion with an object lock legal hold, until it is lifted",
+	},
 }
 
 var backupCmd = cli.Command{
@@ -73,12 +138,31 @@ EXAMPLES:
      {{.Prompt}} {{.HelpName}} u2 --optimized
   2. Backup an instance 'u2', add custom tags of 'k1=v1&k2=v2' form:
      {{.Prompt}} {{.HelpName}} u2 --optimized --tags "category=prod&project=backup"
+     {{.Prompt}} {{.HelpName}} u2 --optimized --tag category=prod --tag project=backup
   3. Backup a remote instance 'u3' on remote 'mylxdserver':
      {{.Prompt}} {{.HelpName}} mylxdserver:u3 --optimized
+  4. Backup an instance 'u2' trading more CPU time for a smaller backup:
+     {{.Prompt}} {{.HelpName}} u2 --compress-level 9
+  5. Backup an instance 'u2', keeping the staged files if the backup fails:
+     {{.Prompt}} {{.HelpName}} u2 --no-cleanup-on-error
+  6. Backup an instance 'u2' without its snapshots:
+     {{.Prompt}} {{.HelpName}} u2 --instance-only
+  7. Print what a backup of instance 'u2' would capture, without backing up:
+     {{.Prompt}} {{.HelpName}} u2 --dry-run
+  8. Backup an instance 'u2' to a cheaper storage class:
+     {{.Prompt}} {{.HelpName}} u2 --storage-class REDUCED_REDUNDANCY
+  9. Backup an instance 'u2' that can not be deleted before 2030:
+     {{.Prompt}} {{.HelpName}} u2 --retain-until 2030-01-01T00:00:00Z --retention-mode compliance
+ 10. Backup an instance 'u2' over a slow link, compressing its profiles:
+     {{.Prompt}} {{.HelpName}} u2 --compress-on-upload
+ 11. Backup an instance 'u2' without compressing it, trading bucket space for CPU time:
+     {{.Prompt}} {{.HelpName}} u2 --compression none
+ 12. Backup an instance 'u2' along with the custom storage volumes attached to it:
+     {{.Prompt}} {{.HelpName}} u2 --volumes
 `,
 }
 
-func backupMain(c *cli.Context) error {
+func backupMain(c *cli.Context) (err error) {
 	if len(c.Args()) > 1 {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
@@ -88,55 +172,87 @@ func backupMain(c *cli.Context) error {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
 
-	partSize := c.Int64("part-size")
-	if partSize == 0 {
-		partSize = 64 * humanize.MiByte
+	if err := validateNames(instance, ""); err != nil {
+		return err
 	}
 
-	tagsHdr := c.String("tags")
-	tagsSet, err := tags.Parse(tagsHdr, true)
+	bopts, err := backupOptsFromContext(c)
 	if err != nil {
 		return err
 	}
 
-	if err := checkInstance(instance); err == nil {
+	if err := checkInstance(instance, ""); err == nil {
 		return fmt.Errorf("no instance found by name: '%s'", instance)
 	}
 
 	backupNamePrefix := "backup_" + time.Now().Format("2006-01-02-15-0405")
 
-	// Save profiles to files.
-	profiles, profileInfo, err := backupProfiles(globalContext, instance, backupNamePrefix)
+	if c.Bool("dry-run") {
+		return backupDryRun(globalContext, bopts, bopts.newBackup(instance, backupNamePrefix))
+	}
+
+	profiles := listInstanceProfiles(instance)
+	var volumes []storageVolume
+	if bopts.Volumes {
+		volumes = listInstanceVolumes(instance)
+	}
+
+	// Staged files are removed once the backup is done, wherever it
+	// failed, unless --no-cleanup-on-error asks to keep them.
+	staged, err := stagedFiles(globalContext, bopts.newBackup(instance, backupNamePrefix), profiles, volumes)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil && c.Bool("no-cleanup-on-error") {
+			for _, fpath := range staged {
+				if _, serr := os.Stat(fpath); serr == nil {
+					fmt.Printf("Keeping staged file %s\n", fpath)
+				}
+			}
+			return
+		}
+		removeStaged(staged)
+	}()
 
-	instanceBackupName, instanceBackupSize, err := backupInstance(globalContext, c.Bool("optimized"), instance, backupNamePrefix)
+	instanceBackupName, instanceBackupSize, err := backupInstance(globalContext, bopts, instance, backupNamePrefix)
 	if err != nil {
 		return err
 	}
 
 	// Backup to MinIO
 
-	// Collect total upload size.
-	var totalSize int64
-	backupPath := path.Join(globalContext.StagingRoot, instanceBackupName)
-	if st, err := os.Stat(backupPath); err != nil {
-		return fmt.Errorf("Unable to stat file %s: %v", backupPath, err)
-	} else {
-		totalSize = st.Size()
+	backupPath, err := globalContext.stagingPath(instanceBackupName)
+	if err != nil {
+		return err
 	}
-	for _, v := range profileInfo {
-		totalSize += v.Size
+	if _, err := os.Stat(backupPath); err != nil {
+		return fmt.Errorf("Unable to stat file %s: %v", backupPath, err)
 	}
 
-	progress := pb.Start64(totalSize)
+	// Profile sizes are added to the total as they are exported.
+	progress := pb.Start64(instanceBackupSize)
 	progress.Set(pb.Bytes, true)
 
-	if err := uploadInstanceBackup(globalContext, c.Bool("optimized"), instance, instanceBackupName, instanceBackupSize, progress, tagsSet, partSize); err != nil {
+	bkp := backup{instance: instance, backupName: backupNamePrefix}
+	if err := globalContext.putIncompleteMarker(bkp); err != nil {
+		return err
+	}
+	if err := uploadInstanceBackup(globalContext, bopts, instance, instanceBackupName, instanceBackupSize, progress); err != nil {
+		return err
+	}
+	manifest, err := backupProfiles(globalContext, bopts, instance, backupNamePrefix, profiles, progress)
+	if err != nil {
+		return err
+	}
+	manifest.Volumes, err = backupVolumes(globalContext, bopts, instance, backupNamePrefix, volumes, progress)
+	if err != nil {
 		return err
 	}
-	if err := uploadProfilesBackup(globalContext, instance, profiles, profileInfo, progress, tagsSet, partSize); err != nil {
+	if err := globalContext.putManifest(bkp, bopts, manifest); err != nil {
+		return err
+	}
+	if err := globalContext.removeIncompleteMarker(bkp); err != nil {
 		return err
 	}
 
@@ -144,62 +260,469 @@ func backupMain(c *cli.Context) error {
 	return err
 }
 
-func uploadInstanceBackup(ctx *lxminContext, optimized bool, instance, backupName string, size int64, bar *pb.ProgressBar, tagsSet *tags.Tags, partSize int64) error {
-	usermetadata := map[string]string{}
-	// Save additional information if the backup is optimized or not.
-	usermetadata["optimized"] = strconv.FormatBool(optimized)
-	usermetadata["compressed"] = "true" // This is always true.
+// backupDryRun - prints the profiles, object keys and estimated size of
+// a backup of the instance, after checking that staging is writable.
+func backupDryRun(ctx *lxminContext, bopts backupOpts, bkp backup) error {
+	instance, backupName := bkp.instance, bkp.backupName
+	stagingRoot := ctx.StagingRoot
+	if stagingRoot == "" {
+		stagingRoot = "."
+	}
+	if err := checkStagingRoot(stagingRoot); err != nil {
+		return err
+	}
 
-	fpath := path.Join(ctx.StagingRoot, backupName)
+	profiles, err := listProfiles(instance)
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 1000 {
+		return fmt.Errorf("More than a 1000 profiles per instance not supported.")
+	}
+
+	var volumes []storageVolume
+	if bopts.Volumes {
+		volumes, err = listVolumes(instance)
+		if err != nil {
+			return err
+		}
+	}
+
+	usage, err := instanceDiskUsage(instance)
+	if err != nil {
+		return err
+	}
+	estimate := "unknown"
+	if usage > 0 {
+		estimate = humanize.IBytes(uint64(usage)) + " (disk usage, before compression)"
+	}
+
+	fmt.Printf("%-12s: %s\n", "Instance", instance)
+	fmt.Printf("%-12s: %s\n", "Destination", path.Join(ctx.Bucket, instance)+"/")
+	fmt.Printf("%-12s: %s\n", "Profiles", strings.Join(profiles, ", "))
+	if bopts.Volumes {
+		names := make([]string, len(volumes))
+		for i, vol := range volumes {
+			names[i] = vol.Pool + "/" + vol.Name
+		}
+		fmt.Printf("%-12s: %s\n", "Volumes", strings.Join(names, ", "))
+	}
+	fmt.Printf("%-12s: %s\n", "Size", estimate)
+	fmt.Printf("%-12s:\n", "Objects")
+	fmt.Printf("  %s\n", bkp.key())
+	for pno, profile := range profiles {
+		fmt.Printf("  %s\n", path.Join(instance, profileBackupName(backupName, pno, profile)))
+	}
+	for vno, vol := range volumes {
+		fmt.Printf("  %s\n", path.Join(instance, volumeBackupName(backupName, vno, vol.Name)))
+	}
+	fmt.Printf("  %s\n", bkp.manifestKey())
+	return nil
+}
+
+// backupOptsFromContext - collects the backup options from the
+// command line, validating them before any work is done.
+func backupOptsFromContext(c *cli.Context) (backupOpts, error) {
+	partSize := c.Int64("part-size")
+	if partSize == 0 {
+		partSize = 64 * humanize.MiByte
+	}
+
+	tagsSet, err := parseBackupTags(c.String("tags"), c.StringSlice("tag"))
+	if err != nil {
+		return backupOpts{}, err
+	}
+
+	compressLevel := c.Int("compress-level")
+	if c.IsSet("compress-level") {
+		if _, err := compressionArg("gzip", compressLevel); err != nil {
+			return backupOpts{}, err
+		}
+	}
+
+	exportArgs := strings.Fields(c.String("lxc-export-args"))
+	uncompressed, err := parseCompression(c.String("compression"), compressLevel, exportArgs)
+	if err != nil {
+		return backupOpts{}, err
+	}
+
+	storageClass := strings.TrimSpace(c.String("storage-class"))
+	if c.IsSet("storage-class") && storageClass == "" {
+		return backupOpts{}, errors.New("--storage-class cannot be empty")
+	}
+
+	mode, retainUntil, err := parseRetention(c.String("retain-until"), c.String("retention-mode"))
+	if err != nil {
+		return backupOpts{}, err
+	}
+
+	bopts := backupOpts{
+		TagsSet:       tagsSet,
+		PartSize:      partSize,
+		Optimized:     c.Bool("optimized"),
+		CompressLevel: compressLevel,
+		Concurrency:   c.Int("concurrency"),
+		StorageClass:  storageClass,
+		InstanceOnly:  c.Bool("instance-only"),
+		GzipProfiles:  c.Bool("compress-on-upload"),
+		Volumes:       c.Bool("volumes"),
+		Uncompressed:  uncompressed,
+		RetentionMode: mode,
+		RetainUntil:   retainUntil,
+		LegalHold:     c.Bool("legal-hold"),
+	}
+	if err := bopts.applyExportArgs(exportArgs); err != nil {
+		return backupOpts{}, err
+	}
+	return bopts, nil
+}
+
+// S3 limits on object tags, checked before anything is exported so that
+// the upload does not fail once the export is done.
+const (
+	maxBackupTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// parseBackupTags - merges tags in 'k1=v1&k2=v2' form with the
+// individual 'k=v' tags passed via repeated `--tag` flags.
+func parseBackupTags(tagsHdr string, tagList []string) (*tags.Tags, error) {
+	var pairs [][2]string
+	for _, tag := range strings.Split(tagsHdr, "&") {
+		if tag == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(tag, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag '%s': %v", tag, err)
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag '%s': %v", tag, err)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	for _, tag := range tagList {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag '%s', expected 'key=value'", tag)
+		}
+		pairs = append(pairs, [2]string{k, v})
+	}
+
+	tagsSet, err := tags.MapToObjectTags(map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		k, v := pair[0], pair[1]
+		if n := utf8.RuneCountInString(k); n > maxTagKeyLength {
+			return nil, fmt.Errorf("tag key '%s' is %d characters long, at most %d are allowed", k, n, maxTagKeyLength)
+		}
+		if n := utf8.RuneCountInString(v); n > maxTagValueLength {
+			return nil, fmt.Errorf("value of tag '%s' is %d characters long, at most %d are allowed", k, n, maxTagValueLength)
+		}
+		if _, ok := tagsSet.ToMap()[k]; ok {
+			// A repeated key replaces the tag, Set refuses it on a full set.
+			tagsSet.Remove(k)
+		} else if tagsSet.Count() == maxBackupTags {
+			return nil, fmt.Errorf("too many tags, at most %d tags are allowed per backup", maxBackupTags)
+		}
+		if err := tagsSet.Set(k, v); err != nil {
+			return nil, fmt.Errorf("invalid tag '%s=%s': %v", k, v, err)
+		}
+	}
+	return tagsSet, nil
+}
+
+func uploadInstanceBackup(ctx *lxminContext, bopts backupOpts, instance, backupName string, size int64, bar *pb.ProgressBar) error {
+	fpath, err := ctx.stagingPath(backupName)
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(fpath)
+	if err != nil {
+		return fmt.Errorf("Unable to checksum instance backup %s: %v", fpath, err)
+	}
 	barReader, err := newBarUpdateReader(fpath, bar, tmplUp)
 	if err != nil {
 		return err
 	}
 
 	defer barReader.Close()
-	defer os.Remove(fpath)
-	opts := minio.PutObjectOptions{
-		UserTags:     tagsSet.ToMap(),
-		PartSize:     uint64(partSize),
-		UserMetadata: usermetadata,
-		ContentType:  mime.TypeByExtension(".tar.gz"),
-	}
-	_, err = globalContext.Clnt.PutObject(context.Background(), globalContext.Bucket, path.Join(instance, backupName), barReader, size, opts)
-	if err != nil {
+	name, _ := instanceBackupName(backupName)
+	bkp := bopts.newBackup(instance, name)
+	if err := ctx.putInstanceBackup(bkp, bopts, barReader, size, sum, nil); err != nil {
 		return fmt.Errorf("Error uploading file %s: %v", fpath, err)
 	}
 	return nil
 }
 
-func uploadProfilesBackup(ctx *lxminContext, instance string, pList []string, prInfo map[string]profileInfo, bar *pb.ProgressBar, tagsSet *tags.Tags, partSize int64) error {
-	for _, profile := range pList {
-		err := func() error {
-			profileFile := prInfo[profile].FileName
-			size := prInfo[profile].Size
-			fpath := path.Join(ctx.StagingRoot, profileFile)
-			barReader, err := newBarUpdateReader(fpath, bar, tmplUp)
-			if err != nil {
-				return err
-			}
-			defer barReader.Close()
-			defer os.Remove(fpath)
+// profileBackupName - profiles are numbered because their order matters,
+// settings in the later profiles override those from earlier profiles.
+func profileBackupName(backupName string, pno int, profile string) string {
+	return fmt.Sprintf("%s_profile_%03d_%s.yaml", backupName, pno, profile)
+}
 
-			opts := minio.PutObjectOptions{
-				UserTags:    tagsSet.ToMap(),
-				PartSize:    uint64(partSize),
-				ContentType: mime.TypeByExtension(".yaml"),
-			}
-			_, err = ctx.Clnt.PutObject(context.Background(), ctx.Bucket, path.Join(instance, profileFile), barReader, size, opts)
+// volumeBackupName - volumes are numbered like profiles, two volumes of
+// different pools may have the same name.
+func volumeBackupName(backupName string, vno int, volume string) string {
+	return fmt.Sprintf("%s_volume_%03d_%s.tar.gz", backupName, vno, volume)
+}
+
+// stagedFiles - returns the paths of all files staged by the backup. The
+// names are derived from the backup, its profiles and volumes instead of
+// matching the staging root against the backup name, which may also
+// match the files of a concurrent backup of another instance.
+func stagedFiles(ctx *lxminContext, bkp backup, profiles []string, volumes []storageVolume) ([]string, error) {
+	names := []string{path.Base(bkp.key())}
+	for pno, profile := range profiles {
+		names = append(names, profileBackupName(bkp.backupName, pno, profile))
+	}
+	for vno, vol := range volumes {
+		names = append(names, volumeBackupName(bkp.backupName, vno, vol.Name))
+	}
+
+	staged := make([]string, 0, len(names))
+	for _, name := range names {
+		fpath, err := ctx.stagingPath(name)
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, fpath)
+	}
+	return staged, nil
+}
+
+// removeStaged - removes the staged files, files never staged or already
+// removed are ignored.
+func removeStaged(staged []string) {
+	for _, fpath := range staged {
+		os.Remove(fpath)
+	}
+}
+
+// defaultProfileConcurrency - profiles exported and uploaded in parallel
+// when not configured.
+const defaultProfileConcurrency = 4
+
+// backupProfiles - exports and uploads the profiles of the instance,
+// with up to bopts.Concurrency profiles in flight so that staging holds
+// only as many profiles, however many profiles the instance has. The
+// first error cancels the remaining uploads, the staged files of the
+// failed profiles are left for the caller to clean up.
+func backupProfiles(ctx *lxminContext, bopts backupOpts, instance, backupName string, profiles []string, bar *pb.ProgressBar) (backupManifest, error) {
+	fpaths := make([]string, len(profiles))
+	for pno, profile := range profiles {
+		fpath, err := ctx.stagingPath(profileBackupName(backupName, pno, profile))
+		if err != nil {
+			return backupManifest{}, err
+		}
+		fpaths[pno] = fpath
+	}
+
+	concurrency := bopts.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultProfileConcurrency
+	}
+
+	opCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	entries := make([]manifestProfile, len(profiles))
+	sem := make(chan struct{}, concurrency)
+	for pno := range profiles {
+		select {
+		case sem <- struct{}{}:
+		case <-opCtx.Done():
+		}
+		if opCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(pno int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			mp, err := backupProfile(opCtx, ctx, bopts, instance, profiles[pno], fpaths[pno], bar)
 			if err != nil {
-				return fmt.Errorf("Error uploading file %s: %v", fpath, err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				return
 			}
-			return nil
-		}()
+			os.Remove(fpaths[pno])
+
+			mp.Index = pno
+			entries[pno] = mp
+		}(pno)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return backupManifest{}, firstErr
+	}
+	return backupManifest{Profiles: entries}, nil
+}
+
+// backupProfile - exports a single profile to fpath and uploads it,
+// returning its manifest entry.
+func backupProfile(opCtx context.Context, ctx *lxminContext, bopts backupOpts, instance, profile, fpath string, bar *pb.ProgressBar) (mp manifestProfile, err error) {
+	size, err := exportProfile(profile, fpath)
+	if err != nil {
+		return mp, err
+	}
+	sum, err := fileSHA256(fpath)
+	if err != nil {
+		return mp, fmt.Errorf("Unable to checksum profile file %s: %v", fpath, err)
+	}
+
+	// The manifest keeps the size and checksum of the profile, restore
+	// decompresses a gzip encoded profile on download.
+	opts := bopts.profilePutOptions()
+	upload := size
+	var r io.ReadCloser
+	if bopts.GzipProfiles {
+		buf, err := gzipFile(fpath)
 		if err != nil {
-			return err
+			return mp, err
 		}
+		opts.ContentEncoding = "gzip"
+		upload = int64(buf.Len())
+		if bar != nil {
+			// Closing the proxy reader would finish the shared bar.
+			bar.AddTotal(upload)
+			r = io.NopCloser(bar.NewProxyReader(buf))
+		} else {
+			r = io.NopCloser(buf)
+		}
+	} else if bar != nil {
+		bar.AddTotal(size)
+		r, err = newBarUpdateReader(fpath, bar, tmplUp)
+	} else {
+		r, err = os.Open(fpath)
 	}
-	return nil
+	if err != nil {
+		return mp, err
+	}
+	defer r.Close()
+
+	err = ctx.Store.Put(opCtx, path.Join(instance, path.Base(fpath)), r, upload, opts)
+	if err != nil {
+		return mp, fmt.Errorf("Error uploading file %s: %v", fpath, err)
+	}
+	return manifestProfile{
+		Name:   profile,
+		Object: path.Base(fpath),
+		Size:   size,
+		SHA256: sum,
+	}, nil
+}
+
+// backupVolumes - exports and uploads the custom storage volumes of the
+// instance one at a time, volumes may be as large as the instance so only
+// one of them is staged at once. bar is optional.
+func backupVolumes(ctx *lxminContext, bopts backupOpts, instance, backupName string, volumes []storageVolume, bar *pb.ProgressBar) ([]manifestVolume, error) {
+	remote, _ := splitRemote(instance)
+	entries := make([]manifestVolume, 0, len(volumes))
+	for vno, vol := range volumes {
+		fpath, err := ctx.stagingPath(volumeBackupName(backupName, vno, vol.Name))
+		if err != nil {
+			return nil, err
+		}
+		size, err := exportVolume(remote, vol, fpath)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := fileSHA256(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to checksum storage volume file %s: %v", fpath, err)
+		}
+
+		var r io.ReadCloser
+		if bar != nil {
+			bar.AddTotal(size)
+			r, err = newBarUpdateReader(fpath, bar, tmplUp)
+		} else {
+			r, err = os.Open(fpath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = ctx.Store.Put(context.Background(), path.Join(instance, path.Base(fpath)), r, size, bopts.volumePutOptions())
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error uploading file %s: %v", fpath, err)
+		}
+		os.Remove(fpath)
+
+		entries = append(entries, manifestVolume{
+			Device: vol.Device,
+			Pool:   vol.Pool,
+			Name:   vol.Name,
+			Object: path.Base(fpath),
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+	return entries, nil
+}
+
+// gzipFile - compresses the file in memory, for small files like
+// profiles.
+func gzipFile(fpath string) (*bytes.Buffer, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %v", fpath, err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gw, f); err != nil {
+		return nil, fmt.Errorf("Unable to compress %s: %v", fpath, err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("Unable to compress %s: %v", fpath, err)
+	}
+	return &buf, nil
+}
+
+// profilePutOptions - upload options of profile objects.
+func (o backupOpts) profilePutOptions() minio.PutObjectOptions {
+	return o.withObjectOptions(minio.PutObjectOptions{
+		UserTags:    o.TagsSet.ToMap(),
+		PartSize:    uint64(o.PartSize),
+		ContentType: mime.TypeByExtension(".yaml"),
+		UserMetadata: map[string]string{
+			metaSchemaVersion: strconv.Itoa(backupSchemaVersion),
+			metaKind:          kindProfile,
+		},
+	})
+}
+
+// volumePutOptions - upload options of storage volume objects.
+func (o backupOpts) volumePutOptions() minio.PutObjectOptions {
+	return o.withObjectOptions(minio.PutObjectOptions{
+		UserTags:    o.TagsSet.ToMap(),
+		PartSize:    uint64(o.PartSize),
+		ContentType: mime.TypeByExtension(".gz"),
+		UserMetadata: map[string]string{
+			metaSchemaVersion: strconv.Itoa(backupSchemaVersion),
+			metaKind:          kindVolume,
+		},
+	})
 }
 
 type barUpdateReader struct {
@@ -227,6 +750,26 @@ func (b *barUpdateReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// Seek - seeks the underlying file and moves the bar along, so an
+// upload that is rewound, e.g. to send it to another endpoint, is not
+// counted twice.
+func (b *barUpdateReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := b.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("barUpdateReader: reader does not support seek")
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	b.bar.Add64(n - cur)
+	return n, nil
+}
+
 // Close closes the underlying reader if it is a io.Closer.
 func (b *barUpdateReader) Close() error {
 	if c, ok := b.r.(io.Closer); ok {
@@ -235,13 +778,17 @@ func (b *barUpdateReader) Close() error {
 	return nil
 }
 
-func backupInstance(ctx *lxminContext, optimized bool, instance, backupNamePrefix string) (string, int64, error) {
-	backup := backupNamePrefix + "_instance.tar.gz"
-	localPath := path.Join(ctx.StagingRoot, backup)
+func backupInstance(ctx *lxminContext, bopts backupOpts, instance, backupNamePrefix string) (string, int64, error) {
+	bkp := bopts.newBackup(instance, backupNamePrefix)
+	backup := path.Base(bkp.key())
+	localPath, err := ctx.stagingPath(backup)
+	if err != nil {
+		return "", 0, err
+	}
 
 	var size int64
 	exportFn := func() tea.Msg {
-		n, err := exportInstance(instance, localPath, optimized)
+		n, err := exportInstance(instance, localPath, bopts)
 		if err != nil {
 			return err
 		}
@@ -258,71 +805,61 @@ func backupInstance(ctx *lxminContext, optimized bool, instance, backupNamePrefi
 	if err := tea.NewProgram(ui).Start(); err != nil {
 		log.Fatalln(err)
 	}
+	// Stop here when the export failed or timed out, the staged tarball
+	// may be partial and must not be uploaded.
+	if ui.err != nil {
+		return "", 0, ui.err
+	}
 
 	return backup, size, nil
 }
 
-type profileInfo struct {
-	FileName string
-	Size     int64
-}
-
-func backupProfiles(ctx *lxminContext, instance, backupNamePrefix string) ([]string, map[string]profileInfo, error) {
+// listInstanceProfiles - lists the profiles of the instance, in the
+// order they are applied.
+func listInstanceProfiles(instance string) []string {
 	var profiles []string
-	{
-		listProfilesFn := func() tea.Msg {
-			ps, err := listProfiles(instance)
-			if err != nil {
-				return err
-			}
-
-			profiles = ps
-			return true
-		}
-		ui := initCmdSpinnerUI(listProfilesFn, cOpts{
-			instance: instance,
-			message:  `%s Listing profiles for instance: %s`,
-		})
-		if err := tea.NewProgram(ui).Start(); err != nil {
-			log.Fatalln(err)
+	listProfilesFn := func() tea.Msg {
+		ps, err := listProfiles(instance)
+		if err != nil {
+			return err
 		}
+
+		profiles = ps
+		return true
+	}
+	ui := initCmdSpinnerUI(listProfilesFn, cOpts{
+		instance: instance,
+		message:  `%s Listing profiles for instance: %s`,
+	})
+	if err := tea.NewProgram(ui).Start(); err != nil {
+		log.Fatalln(err)
 	}
 
 	if len(profiles) > 1000 {
 		log.Fatalf("More than a 1000 profiles per instance not supported.")
 	}
+	return profiles
+}
 
-	pInfo := make(map[string]profileInfo, len(profiles))
-	for pno, profile := range profiles {
-		// Profiles are numbered because their order matters - settings
-		// in the later profiles override those from earlier profiles.
-		profileFile := fmt.Sprintf("%s_profile_%03d_%s.yaml", backupNamePrefix, pno, profile)
-		profilePath := path.Join(ctx.StagingRoot, profileFile)
-
-		var prSize int64
-		exportProfileFn := func() tea.Msg {
-			n, err := exportProfile(profile, profilePath)
-			if err != nil {
-				return err
-			}
-			prSize = n
-			return true
-		}
-
-		ui := initCmdSpinnerUI(exportProfileFn, cOpts{
-			instance: instance,
-			message:  `%s Fetching profile '` + profile + `' for instance: %s`,
-		})
-
-		if err := tea.NewProgram(ui).Start(); err != nil {
-			log.Fatalln(err)
+// listInstanceVolumes - lists the custom storage volumes attached to the
+// instance.
+func listInstanceVolumes(instance string) []storageVolume {
+	var volumes []storageVolume
+	listVolumesFn := func() tea.Msg {
+		vs, err := listVolumes(instance)
+		if err != nil {
+			return err
 		}
 
-		pInfo[profile] = profileInfo{
-			FileName: profileFile,
-			Size:     prSize,
-		}
+		volumes = vs
+		return true
 	}
-
-	return profiles, pInfo, nil
+	ui := initCmdSpinnerUI(listVolumesFn, cOpts{
+		instance: instance,
+		message:  `%s Listing storage volumes for instance: %s`,
+	})
+	if err := tea.NewProgram(ui).Start(); err != nil {
+		log.Fatalln(err)
+	}
+	return volumes
 }
@@ -0,0 +1,247 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// fakeProfileExport - fakes 'lxc profile show', each export takes a while
+// and records the number of exports in flight when it started. Exports
+// of the failing profile fail right away.
+func fakeProfileExport(t *testing.T, failing string) (inFlight func() []int) {
+	t.Helper()
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	started := filepath.Join(dir, "started")
+	fakeLXC(t, `touch `+running+`/$$
+ls `+running+` | wc -l >> `+started+`
+if [ "$3" = "`+failing+`" ]; then
+	rm `+running+`/$$
+	echo "Error: Profile not found" >&2
+	exit 1
+fi
+sleep 0.05
+rm `+running+`/$$
+echo "name: $3"
+`)
+	return func() []int {
+		data, _ := os.ReadFile(started)
+		var counts []int
+		for _, line := range strings.Fields(string(data)) {
+			n, err := strconv.Atoi(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts = append(counts, n)
+		}
+		return counts
+	}
+}
+
+func profileBackupOpts(concurrency int) backupOpts {
+	tagsSet, _ := tags.NewTags(nil, true)
+	return backupOpts{TagsSet: tagsSet, Concurrency: concurrency}
+}
+
+func TestBackupProfilesConcurrency(t *testing.T) {
+	ms := newTestContext(t)
+	inFlight := fakeProfileExport(t, "")
+
+	var profiles []string
+	for i := 0; i < 10; i++ {
+		profiles = append(profiles, fmt.Sprintf("p%d", i))
+	}
+	m, err := backupProfiles(globalContext, profileBackupOpts(3), "u1", "b1", profiles, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := inFlight()
+	if len(counts) != len(profiles) {
+		t.Fatalf("expected %d exports, got %d", len(profiles), len(counts))
+	}
+	for _, n := range counts {
+		if n > 3 {
+			t.Fatalf("expected at most 3 exports at once, got %d", n)
+		}
+	}
+	// The manifest keeps the order of the profiles.
+	for i, mp := range m.Profiles {
+		if mp.Name != profiles[i] || mp.Index != i {
+			t.Errorf("expected profile %s at %d, got %+v", profiles[i], i, mp)
+		}
+	}
+	if got := len(ms.keys()); got != len(profiles) {
+		t.Errorf("expected %d uploaded profiles, got %d", len(profiles), got)
+	}
+}
+
+func TestBackupProfilesCancel(t *testing.T) {
+	newTestContext(t)
+	inFlight := fakeProfileExport(t, "p0")
+
+	var profiles []string
+	for i := 0; i < 10; i++ {
+		profiles = append(profiles, fmt.Sprintf("p%d", i))
+	}
+	_, err := backupProfiles(globalContext, profileBackupOpts(2), "u1", "b1", profiles, nil)
+	if err == nil || !strings.Contains(err.Error(), "Profile not found") {
+		t.Fatalf("expected the export of p0 to fail, got %v", err)
+	}
+	// Only the exports started before the failure ran, no profile was
+	// exported after it.
+	if n := len(inFlight()); n > 2 {
+		t.Fatalf("expected no exports after the first error, got %d exports", n)
+	}
+}
+
+func TestBackupProfilesGzip(t *testing.T) {
+	ms := newTestContext(t)
+	fakeProfileExport(t, "")
+
+	bopts := profileBackupOpts(2)
+	bopts.GzipProfiles = true
+	m, err := backupProfiles(globalContext, bopts, "u1", "b1", []string{"default", "web"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ri restoreInfo
+	for _, mp := range m.Profiles {
+		key := path.Join("u1", mp.Object)
+		r, oi, err := ms.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc := oi.Metadata.Get("Content-Encoding"); enc != "gzip" {
+			t.Errorf("%s: expected gzip content encoding, got %q", key, enc)
+		}
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		data, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The manifest describes the uncompressed profile.
+		want := "name: " + mp.Name + "\n"
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", key, want, data)
+		}
+		if mp.Size != int64(len(want)) || mp.SHA256 != sha256Hex([]byte(want)) {
+			t.Errorf("%s: unexpected manifest entry %+v", key, mp)
+		}
+		ri.profileKeys = append(ri.profileKeys, key)
+		ri.checksums = append(ri.checksums, mp.SHA256)
+	}
+
+	// Restore decompresses the profiles and checks them against the manifest.
+	if err := globalContext.downloadProfiles(ri, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseBackupTagsMerge(t *testing.T) {
+	testCases := []struct {
+		tags    string
+		tagList []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{want: map[string]string{}},
+		{tags: "OS=Ubuntu&Version=20.04", want: map[string]string{"OS": "Ubuntu", "Version": "20.04"}},
+		{tagList: []string{"OS=Ubuntu", "Version=20.04"}, want: map[string]string{"OS": "Ubuntu", "Version": "20.04"}},
+		{tags: "Build=10", tagList: []string{"OS=Ubuntu"}, want: map[string]string{"Build": "10", "OS": "Ubuntu"}},
+		// `--tags` is query escaped, `--tag` is taken as is.
+		{tags: "note=two+words%2B", tagList: []string{"url=host:9000/a+b"}, want: map[string]string{"note": "two words+", "url": "host:9000/a+b"}},
+		// A `--tag` given after `--tags` replaces its value.
+		{tags: "OS=Debian", tagList: []string{"OS=Ubuntu"}, want: map[string]string{"OS": "Ubuntu"}},
+		{tagList: []string{"OS"}, wantErr: true},
+		{tags: "OS=%zz", wantErr: true},
+	}
+	for _, tc := range testCases {
+		tagsSet, err := parseBackupTags(tc.tags, tc.tagList)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q %q: expected an error", tc.tags, tc.tagList)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: unexpected error %v", tc.tags, tc.tagList, err)
+			continue
+		}
+		if got := tagsSet.ToMap(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q %q: expected %v, got %v", tc.tags, tc.tagList, tc.want, got)
+		}
+	}
+}
+
+func TestParseBackupTagsLimits(t *testing.T) {
+	tagList := func(n int) []string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = fmt.Sprintf("k%d=v", i)
+		}
+		return list
+	}
+	testCases := []struct {
+		name    string
+		tags    string
+		tagList []string
+		wantErr string
+	}{
+		{name: "max tags", tagList: tagList(maxBackupTags)},
+		{name: "too many tags", tagList: tagList(maxBackupTags + 1), wantErr: "too many tags"},
+		{name: "too many merged tags", tags: "extra=v", tagList: tagList(maxBackupTags), wantErr: "too many tags"},
+		{name: "replaced tag", tagList: append(tagList(maxBackupTags), "k0=w")},
+		{name: "max key", tagList: []string{strings.Repeat("k", maxTagKeyLength) + "=v"}},
+		{name: "long key", tagList: []string{strings.Repeat("k", maxTagKeyLength+1) + "=v"}, wantErr: "tag key"},
+		{name: "max value", tags: "k=" + strings.Repeat("v", maxTagValueLength)},
+		{name: "long value", tags: "k=" + strings.Repeat("v", maxTagValueLength+1), wantErr: "value of tag 'k'"},
+	}
+	for _, tc := range testCases {
+		_, err := parseBackupTags(tc.tags, tc.tagList)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
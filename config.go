@@ -0,0 +1,115 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile - global flag values loaded from a YAML config file, keyed
+// by flag name, e.g. 'endpoint' or 'access-key'.
+type configFile struct {
+	path   string
+	values map[string]string
+}
+
+// defaultConfigPath - config file used when --config is not set, it is
+// optional.
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".lxmin", "config.yaml")
+}
+
+// loadConfig - reads a config file, keys must be names of global flags.
+func loadConfig(fpath string) (*configFile, error) {
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err = yaml.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s: %v", fpath, err)
+	}
+
+	known := map[string]bool{}
+	for _, f := range globalFlags {
+		known[strings.TrimSpace(strings.Split(f.GetName(), ",")[0])] = true
+	}
+
+	cfg := &configFile{path: fpath, values: map[string]string{}}
+	for key, value := range raw {
+		if !known[key] || key == "config" {
+			return nil, fmt.Errorf("Unknown key '%s' in config file %s", key, fpath)
+		}
+		if value == nil {
+			continue
+		}
+		cfg.values[key] = fmt.Sprint(value)
+	}
+	return cfg, nil
+}
+
+// applyConfig - loads --config, or the default config file if present,
+// and sets the global flags that are neither passed on the command line
+// nor in the environment. Returns nil without a config file.
+func applyConfig(c *cli.Context) (*configFile, error) {
+	fpath := ctxString(c, "config")
+	explicit := fpath != ""
+	if !explicit {
+		fpath = defaultConfigPath()
+		if fpath == "" {
+			return nil, nil
+		}
+	}
+
+	cfg, err := loadConfig(fpath)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to load config file: %v", err)
+	}
+
+	keys := make([]string, 0, len(cfg.values))
+	for key := range cfg.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// The command line and the environment take precedence.
+		if c.IsSet(key) || c.GlobalIsSet(key) {
+			continue
+		}
+		if err := c.Set(key, cfg.values[key]); err != nil {
+			return nil, fmt.Errorf("Invalid value '%s' for '%s' in config file %s: %v", cfg.values[key], key, fpath, err)
+		}
+	}
+	return cfg, nil
+}
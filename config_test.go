@@ -0,0 +1,78 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minio/cli"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	cfgData := "bucket: cfgbucket\nimport-retries: 7\nstaging: /var/lib/lxmin\n"
+	if err := os.WriteFile(cfgPath, []byte(cfgData), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LXMIN_BUCKET", "envbucket")
+	t.Setenv("LXMIN_IMPORT_RETRIES", "5")
+
+	args := []string{"lxmin", "check", "--config", cfgPath, "--bucket", "flagbucket"}
+	prevArgs := os.Args
+	os.Args = args
+	t.Cleanup(func() { os.Args = prevArgs })
+
+	type setting struct{ value, source string }
+	got := map[string]setting{}
+	app := cli.NewApp()
+	app.Name = "lxmin"
+	app.Commands = []cli.Command{{
+		Name:  "check",
+		Flags: globalFlags,
+		Action: func(c *cli.Context) error {
+			cfg, err := applyConfig(c)
+			if err != nil {
+				return err
+			}
+			got["bucket"] = setting{ctxString(c, "bucket"), flagSource("bucket", "LXMIN_BUCKET", cfg)}
+			got["import-retries"] = setting{c.String("import-retries"), flagSource("import-retries", "LXMIN_IMPORT_RETRIES", cfg)}
+			got["staging"] = setting{ctxString(c, "staging"), flagSource("staging", "LXMIN_STAGING_ROOT", cfg)}
+			got["notify-endpoint"] = setting{ctxString(c, "notify-endpoint"), flagSource("notify-endpoint", "LXMIN_NOTIFY_ENDPOINT", cfg)}
+			return nil
+		},
+	}}
+	if err := app.Run(args); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line wins over the environment, which wins over the
+	// config file.
+	want := map[string]setting{
+		"bucket":          {"flagbucket", "flag"},
+		"import-retries":  {"5", "env (LXMIN_IMPORT_RETRIES)"},
+		"staging":         {"/var/lib/lxmin", "config (" + cfgPath + ")"},
+		"notify-endpoint": {"", "default"},
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s: expected %+v, got %+v", name, w, got[name])
+		}
+	}
+}
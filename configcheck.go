@@ -0,0 +1,135 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/minio/cli"
+)
+
+var configCheckCmd = cli.Command{
+	Name:   "config-check",
+	Usage:  "print the effective configuration and validate it",
+	Action: configCheckMain,
+	Flags:  globalFlags,
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS]
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Print where each setting comes from and validate the configuration:
+     {{.Prompt}} {{.HelpName}}
+`,
+}
+
+// redactedFlags - flags whose values are never printed.
+var redactedFlags = map[string]bool{
+	"secret-key":  true,
+	"encrypt-key": true,
+	"api-token":   true,
+}
+
+// flagOnCommandLine - reports if the flag was passed on the command line,
+// before or after the command name. The cli package only tells whether a
+// flag is set either on the command line or in the environment.
+func flagOnCommandLine(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// flagSource - returns where the value of the flag comes from, the
+// command line takes precedence over the environment and the config
+// file. cfg is nil without a config file.
+func flagSource(name, envVar string, cfg *configFile) string {
+	if flagOnCommandLine(os.Args[1:], name) {
+		return "flag"
+	}
+	if envVar != "" {
+		if _, ok := os.LookupEnv(envVar); ok {
+			return "env (" + envVar + ")"
+		}
+	}
+	if cfg != nil {
+		if _, ok := cfg.values[name]; ok {
+			return "config (" + cfg.path + ")"
+		}
+	}
+	return "default"
+}
+
+func configCheckMain(c *cli.Context) error {
+	cfg, err := applyConfig(c)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVALUE\tSOURCE")
+	for _, f := range globalFlags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+
+		var value, envVar string
+		switch f := f.(type) {
+		case cli.StringFlag:
+			value, envVar = ctxString(c, name), f.EnvVar
+		case cli.BoolFlag:
+			value, envVar = strconv.FormatBool(ctxBool(c, name)), f.EnvVar
+		case cli.BoolTFlag:
+			value, envVar = strconv.FormatBool(ctxBoolT(c, name)), f.EnvVar
+		case cli.IntFlag:
+			value, envVar = strconv.Itoa(ctxInt(c, name)), f.EnvVar
+		case cli.DurationFlag:
+			value, envVar = ctxDuration(c, name).String(), f.EnvVar
+		default:
+			continue
+		}
+		if redactedFlags[name] && value != "" {
+			value = "<redacted>"
+		}
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, value, flagSource(name, envVar, cfg))
+	}
+	tw.Flush()
+	fmt.Println()
+
+	if err := setGlobalsFromContext(c); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
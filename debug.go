@@ -0,0 +1,130 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/cli"
+	"github.com/minio/minio-go/v7"
+)
+
+var debugCmd = cli.Command{
+	Name:   "debug",
+	Usage:  "troubleshoot backup layout issues",
+	Hidden: true,
+	Subcommands: []cli.Command{
+		debugListObjectsCmd,
+	},
+}
+
+var debugListObjectsFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "versions",
+		Usage: "list all object versions and delete markers, metadata is not returned with versions",
+	},
+}
+
+var debugListObjectsCmd = cli.Command{
+	Name:   "list-objects",
+	Usage:  "print every object under the instance prefix without any filtering",
+	Action: debugListObjectsMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(debugListObjectsFlags, globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Print all objects stored for instance 'u2', with their metadata:
+     {{.Prompt}} {{.HelpName}} u2
+  2. Print all object versions and delete markers for instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2 --versions
+`,
+}
+
+// rawObject - object as listed, one JSON document per line.
+type rawObject struct {
+	Key            string            `json:"key"`
+	Size           int64             `json:"size"`
+	ETag           string            `json:"etag,omitempty"`
+	LastModified   time.Time         `json:"lastModified"`
+	VersionID      string            `json:"versionId,omitempty"`
+	IsLatest       bool              `json:"isLatest,omitempty"`
+	IsDeleteMarker bool              `json:"isDeleteMarker,omitempty"`
+	StorageClass   string            `json:"storageClass,omitempty"`
+	UserMetadata   map[string]string `json:"userMetadata,omitempty"`
+}
+
+func debugListObjectsMain(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	if instance == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+	if instance == "*" {
+		return errWildcardInstance
+	}
+	if err := validateNames(instance, ""); err != nil {
+		return err
+	}
+
+	opts := minio.ListObjectsOptions{
+		Prefix:    path.Clean(instance) + "/",
+		Recursive: true,
+	}
+	if c.Bool("versions") {
+		opts.WithVersions = true
+	} else {
+		opts.WithMetadata = true
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for obj := range globalContext.Store.List(context.Background(), opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := enc.Encode(rawObject{
+			Key:            obj.Key,
+			Size:           obj.Size,
+			ETag:           obj.ETag,
+			LastModified:   obj.LastModified,
+			VersionID:      obj.VersionID,
+			IsLatest:       obj.IsLatest,
+			IsDeleteMarker: obj.IsDeleteMarker,
+			StorageClass:   obj.StorageClass,
+			UserMetadata:   obj.UserMetadata,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -71,7 +71,15 @@ func deleteMain(c *cli.Context) error {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
 
+	if instance == "*" {
+		return errWildcardInstance
+	}
+
 	backupName := strings.TrimSpace(c.Args().Get(1))
+	if err := validateNames(instance, backupName); err != nil {
+		return err
+	}
+
 	deleteAll := c.Bool("all")
 	isForceOn := c.Bool("force")
 
@@ -83,6 +91,12 @@ func deleteMain(c *cli.Context) error {
 		return errors.New("Use the --all flag to delete all backups or provide a backup name")
 	}
 
+	if deleteAll {
+		if err := checkDeleteAll(instance); err != nil {
+			return err
+		}
+	}
+
 	if backupName != "" && deleteAll && !isForceOn {
 		return errors.New("DANGEROUS operation: this will delete **all** backups for the given instance - if you are sure add the --force flag")
 	}
@@ -90,9 +104,9 @@ func deleteMain(c *cli.Context) error {
 	var err error
 	if backupName != "" {
 		bkp := backup{instance: instance, backupName: backupName}
-		err = globalContext.DeleteBackup(bkp)
+		_, err = globalContext.DeleteBackup(bkp)
 	} else {
-		err = globalContext.DeleteAllBackups(instance)
+		_, err = globalContext.DeleteAllBackups(instance)
 	}
 	if err != nil {
 		return err
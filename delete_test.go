@@ -0,0 +1,68 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDeleteWildcardInstance(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+	keys := ms.keys()
+
+	for _, args := range [][]string{
+		{"*", "b1"},
+		{"--all", "--force", "*"},
+	} {
+		if err := runCommand(t, deleteCmd, args...); err != errWildcardInstance {
+			t.Errorf("%v: expected %v, got %v", args, errWildcardInstance, err)
+		}
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("expected no objects to be deleted, got %v", got)
+	}
+
+	if err := runCommand(t, deleteCmd, "u1", "b1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ms.keys(); len(got) != 0 {
+		t.Errorf("expected all objects to be deleted, got %v", got)
+	}
+}
+
+func TestDeleteReservedNames(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default"}})
+	keys := ms.keys()
+
+	// The profile and manifest of a backup are not backups of their own.
+	for _, name := range []string{"b1_profile_000_default.yaml", "b1_manifest.json"} {
+		if err := runCommand(t, deleteCmd, "u1", name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if rec := serveTest(t, http.MethodDelete, "/1.0/instances/u1/backups/"+name); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusBadRequest, rec.Code)
+		}
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("expected no objects to be deleted, got %v", got)
+	}
+}
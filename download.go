@@ -0,0 +1,123 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/cli"
+)
+
+var downloadFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "output, o",
+		Value: ".",
+		Usage: "directory to download the backup files to, created if missing",
+	},
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "overwrite existing files in the output directory",
+	},
+}
+
+var downloadCmd = cli.Command{
+	Name:   "download",
+	Usage:  "download the files of a backup from MinIO without restoring it",
+	Action: downloadMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(downloadFlags, globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME BACKUPNAME
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Download backup 'backup_2022-02-16-04-1040' for instance 'u2' to '/srv/backups/u2':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --output /srv/backups/u2
+`,
+}
+
+func downloadMain(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	if instance == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if instance == "*" {
+		return errWildcardInstance
+	}
+
+	backupName := strings.TrimSpace(c.Args().Get(1))
+	if backupName == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if err := validateNames(instance, backupName); err != nil {
+		return err
+	}
+
+	outDir := c.String("output")
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return fmt.Errorf("Unable to create output directory %s: %v", outDir, err)
+	}
+
+	// Download to the output directory instead of the staging root.
+	ctx := *globalContext
+	ctx.StagingRoot = outDir
+	if ctx.DerefSymlinks {
+		root, err := resolveStagingRoot(outDir)
+		if err != nil {
+			return err
+		}
+		ctx.StagingRoot = root
+	}
+
+	bkp := ctx.resolveBackup(backup{instance: instance, backupName: backupName})
+	resInfo, err := collectBackupInfo(&ctx, bkp, false)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("force") {
+		keys := append([]string{bkp.key()}, resInfo.profileKeys...)
+		for _, key := range keys {
+			fpath := filepath.Join(outDir, path.Base(key))
+			if _, err := os.Stat(fpath); err == nil {
+				return fmt.Errorf("File %s already exists, use --force to overwrite", fpath)
+			}
+		}
+	}
+
+	if err := downloadBackupFiles(&ctx, bkp, resInfo, false); err != nil {
+		return err
+	}
+	fmt.Printf("Downloaded backup %s to %s\n", backupName, outDir)
+	return nil
+}
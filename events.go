@@ -0,0 +1,101 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// maxRecordedEvents - events kept by the built-in receiver, older events
+// are dropped.
+const maxRecordedEvents = 1000
+
+// eventLog - in memory receiver of notification events, enabled with
+// --self-notify for demos and testing without an external webhook.
+type eventLog struct {
+	sync.Mutex
+	events []json.RawMessage
+}
+
+// globalEvents - nil unless --self-notify.
+var globalEvents *eventLog
+
+func (l *eventLog) record(event json.RawMessage) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.events) == maxRecordedEvents {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, event)
+}
+
+// observe - records an event sent by this service, a nil log ignores it.
+func (l *eventLog) observe(e eventInfo) {
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	l.record(data)
+}
+
+func (l *eventLog) list() []json.RawMessage {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]json.RawMessage{}, l.events...)
+}
+
+// postEventsHandler - records an event posted by a notifier.
+func postEventsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	var e struct {
+		OpType string `json:"opType"`
+		State  string `json:"state"`
+	}
+	if err = json.Unmarshal(data, &e); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+	if e.OpType == "" || e.State == "" {
+		writeErrorResponse(w, errors.New("event requires an opType and a state"))
+		return
+	}
+
+	globalEvents.record(data)
+	writeSuccessResponse(w, nil, true)
+}
+
+// listEventsHandler - returns the recorded events, oldest first.
+func listEventsHandler(w http.ResponseWriter, r *http.Request) {
+	writeSuccessResponse(w, globalEvents.list(), true)
+}
@@ -20,52 +20,336 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/minio/cli"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"github.com/minio/pkg/v2/certs"
 )
 
 var globalContext *lxminContext
 
+// probeEndpoint - fails fast if the MinIO endpoint is not reachable instead
+// of stalling on the transport timeouts.
+func probeEndpoint(u *url.URL, timeout time.Duration) error {
+	if u.Scheme == "unix" {
+		conn, err := net.DialTimeout("unix", u.Path, timeout)
+		if err != nil {
+			return fmt.Errorf("MinIO endpoint %s unreachable: %v", u.String(), err)
+		}
+		return conn.Close()
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return fmt.Errorf("MinIO endpoint %s unreachable: %v", u.String(), err)
+	}
+	return conn.Close()
+}
+
+// parseEndpoint - parses and validates the MinIO endpoint, an endpoint
+// without a scheme such as 'minio.lan:9000' defaults to https, or is
+// rejected unless assumeHTTPS. The path of an endpoint behind a reverse
+// proxy such as 'https://host/s3/' is kept for pathPrefixTransport. A
+// co-located MinIO may be reached over its unix socket with
+// 'unix:///run/minio.sock'.
+func parseEndpoint(endpoint string, assumeHTTPS bool) (*url.URL, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return nil, errors.New("MinIO endpoint is not set, please use --endpoint or LXMIN_ENDPOINT")
+	}
+	if !strings.Contains(endpoint, "://") {
+		if !assumeHTTPS {
+			return nil, fmt.Errorf("Invalid MinIO endpoint '%s': scheme is missing, please use 'https://%s' or 'http://%s'", endpoint, endpoint, endpoint)
+		}
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MinIO endpoint '%s': %v", endpoint, err)
+	}
+	if u.Scheme == "unix" {
+		return u, checkSocket(endpoint, u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid MinIO endpoint '%s': scheme must be http, https or unix, found '%s'", endpoint, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid MinIO endpoint '%s': host is missing", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("Invalid MinIO endpoint '%s': query and fragment are not supported", endpoint)
+	}
+	return u, nil
+}
+
+// checkSocket - validates a unix socket endpoint, the socket must exist.
+func checkSocket(endpoint string, u *url.URL) error {
+	if u.Host != "" || u.Path == "" {
+		return fmt.Errorf("Invalid MinIO endpoint '%s': expected the absolute path of a socket, e.g. 'unix:///run/minio.sock'", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("Invalid MinIO endpoint '%s': query and fragment are not supported", endpoint)
+	}
+	st, err := os.Stat(u.Path)
+	if err != nil {
+		return fmt.Errorf("Invalid MinIO endpoint '%s': %v", endpoint, err)
+	}
+	if st.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Invalid MinIO endpoint '%s': %s is not a unix socket", endpoint, u.Path)
+	}
+	return nil
+}
+
+// parseEndpoints - parses a comma separated list of endpoints, in order
+// of preference.
+func parseEndpoints(endpoints string, assumeHTTPS bool) ([]*url.URL, error) {
+	var us []*url.URL
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if strings.TrimSpace(endpoint) == "" && len(us) > 0 {
+			continue
+		}
+		u, err := parseEndpoint(endpoint, assumeHTTPS)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, nil
+}
+
+// probeEndpoints - fails if none of the endpoints is reachable.
+func probeEndpoints(endpoints []*url.URL, timeout time.Duration) (err error) {
+	for _, u := range endpoints {
+		if err = probeEndpoint(u, timeout); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// newS3Client - creates the client of an endpoint.
+func newS3Client(u *url.URL, creds *credentials.Credentials) (*minio.Client, error) {
+	opts := &minio.Options{
+		Creds:  creds,
+		Secure: u.Scheme == "https",
+	}
+	if u.Scheme == "unix" {
+		tr, err := minio.DefaultTransport(false)
+		if err != nil {
+			return nil, err
+		}
+		tr.DialContext = unixDialer(u.Path)
+		opts.Transport = tr
+		// There is no host name to put the bucket in.
+		opts.BucketLookup = minio.BucketLookupPath
+		return minio.New("localhost", opts)
+	}
+	if prefix := strings.TrimSuffix(u.Path, "/"); prefix != "" {
+		tr, err := minio.DefaultTransport(opts.Secure)
+		if err != nil {
+			return nil, err
+		}
+		opts.Transport = &pathPrefixTransport{prefix: prefix, base: tr}
+		// Virtual host style requests do not go through the proxy path.
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	return minio.New(u.Host, opts)
+}
+
+// unixDialer - dials the unix socket whatever the address of the request,
+// requests are sent to 'localhost'.
+func unixDialer(socket string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}
+
+// pathPrefixTransport - prepends the path of an endpoint served under a
+// sub-path of a reverse proxy, e.g. 'https://host/s3/', to all requests.
+// Requests are signed without the prefix, so the proxy must strip it
+// before forwarding to MinIO.
+type pathPrefixTransport struct {
+	prefix string
+	base   http.RoundTripper
+}
+
+func (t *pathPrefixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Path = t.prefix + req.URL.Path
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = t.prefix + req.URL.RawPath
+	}
+	return t.base.RoundTrip(req)
+}
+
+// parseSSECKey - parses the SSE-C key, given either as 32 bytes or as
+// 32 bytes base64 encoded.
+func parseSSECKey(key string) (encrypt.ServerSide, error) {
+	k := []byte(key)
+	if len(k) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != 32 {
+			return nil, errors.New("encryption key must be 32 bytes, or 32 bytes base64 encoded")
+		}
+		k = decoded
+	}
+	return encrypt.NewSSEC(k)
+}
+
+// ctxString - reads a global flag passed either before or after the
+// command name, the value after the command name takes precedence.
+func ctxString(c *cli.Context, name string) string {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalString(name)
+	}
+	return c.String(name)
+}
+
+// ctxBool - same as ctxString for boolean flags.
+func ctxBool(c *cli.Context, name string) bool {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalBool(name)
+	}
+	return c.Bool(name)
+}
+
+// ctxBoolT - same as ctxString for boolean flags defaulting to true.
+func ctxBoolT(c *cli.Context, name string) bool {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalBoolT(name)
+	}
+	return c.BoolT(name)
+}
+
+// ctxInt - same as ctxString for integer flags.
+func ctxInt(c *cli.Context, name string) int {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalInt(name)
+	}
+	return c.Int(name)
+}
+
+// ctxDuration - same as ctxString for duration flags.
+func ctxDuration(c *cli.Context, name string) time.Duration {
+	if !c.IsSet(name) && c.GlobalIsSet(name) {
+		return c.GlobalDuration(name)
+	}
+	return c.Duration(name)
+}
+
 // Set global states. NOTE: It is deliberately kept monolithic to ensure we dont miss out any flags.
 func setGlobalsFromContext(c *cli.Context) error {
-	u, err := url.Parse(c.String("endpoint"))
-	if err != nil {
+	if _, err := applyConfig(c); err != nil {
 		return err
 	}
 
-	s3Client, err := minio.New(u.Host, &minio.Options{
-		Creds:  credentials.NewStaticV4(c.String("access-key"), c.String("secret-key"), ""),
-		Secure: u.Scheme == "https",
-	})
+	if err := setLXCOptions(c); err != nil {
+		return err
+	}
+
+	endpoints, err := parseEndpoints(ctxString(c, "endpoint"), ctxBoolT(c, "assume-https"))
 	if err != nil {
 		return err
 	}
 
+	if timeout := ctxDuration(c, "endpoint-health-timeout"); timeout > 0 {
+		if err := probeEndpoints(endpoints, timeout); err != nil {
+			return err
+		}
+	}
+
+	var sse encrypt.ServerSide
+	if key := ctxString(c, "encrypt-key"); key != "" {
+		for _, u := range endpoints {
+			if u.Scheme != "https" {
+				return errors.New("SSE-C encryption requires an https endpoint")
+			}
+		}
+		if sse, err = parseSSECKey(key); err != nil {
+			return err
+		}
+	}
+	if keyID := ctxString(c, "sse-kms-key-id"); keyID != "" {
+		if sse != nil {
+			return errors.New("--encrypt-key and --sse-kms-key-id are mutually exclusive, please use only one")
+		}
+		if sse, err = encrypt.NewSSEKMS(keyID, nil); err != nil {
+			return err
+		}
+	}
+
+	creds := credentials.NewStaticV4(ctxString(c, "access-key"), ctxString(c, "secret-key"), "")
+	stores := make([]BackupStore, 0, len(endpoints))
+	for _, u := range endpoints {
+		s3Client, err := newS3Client(u, creds)
+		if err != nil {
+			return err
+		}
+		stores = append(stores, newMinioStore(s3Client, ctxString(c, "bucket"), sse))
+	}
+	store := stores[0]
+	if len(stores) > 1 {
+		store = &failoverStore{stores: stores}
+	}
+
 	globalContext = &lxminContext{
-		Clnt:        s3Client,
-		Bucket:      c.String("bucket"),
-		StagingRoot: c.String("staging"),
+		Store:         store,
+		Endpoint:      endpoints[0].String(),
+		Bucket:        ctxString(c, "bucket"),
+		StagingRoot:   ctxString(c, "staging"),
+		DerefSymlinks: ctxBool(c, "dereference-symlinks"),
+		Strict:        ctxBool(c, "strict"),
 	}
 
-	if c.String("cert") != "" || c.String("key") != "" {
-		tlsCerts, err := certs.NewManager(context.Background(), c.String("cert"), c.String("key"), loadX509KeyPair)
+	if globalContext.StagingRoot != "" {
+		if err := checkStagingRoot(globalContext.StagingRoot); err != nil {
+			return err
+		}
+	}
+
+	if globalContext.DerefSymlinks {
+		stagingRoot, err := resolveStagingRoot(globalContext.StagingRoot)
+		if err != nil {
+			return err
+		}
+		globalContext.StagingRoot = stagingRoot
+	}
+
+	if ctxString(c, "cert") != "" || ctxString(c, "key") != "" {
+		tlsCerts, err := certs.NewManager(context.Background(), ctxString(c, "cert"), ctxString(c, "key"), loadX509KeyPair)
 		if err != nil {
 			return err
 		}
 
-		publicCerts, err := parsePublicCertFile(c.String("cert"))
+		publicCerts, err := parsePublicCertFile(ctxString(c, "cert"))
 		if err != nil {
 			return err
 		}
 
-		rootCAs, err := certs.GetRootCAs(c.String("capath"))
+		rootCAs, err := certs.GetRootCAs(ctxString(c, "capath"))
 		if err != nil {
 			return err
 		}
@@ -78,9 +362,28 @@ func setGlobalsFromContext(c *cli.Context) error {
 		globalContext.RootCAs = rootCAs
 	}
 
-	globalContext.NotifyEndpoint = c.String("notify-endpoint")
+	globalContext.NotifyEndpoint = ctxString(c, "notify-endpoint")
+	globalContext.NotifyRetries = ctxInt(c, "notify-retries")
+	globalContext.NotifyTimeout = ctxDuration(c, "notify-timeout")
+	globalContext.APIToken = ctxString(c, "api-token")
+	globalContext.MaxBackupsPerInstance = ctxInt(c, "max-backups-per-instance")
+	globalContext.ImportRetries = ctxInt(c, "import-retries")
+	if maxSize := ctxString(c, "max-object-size"); maxSize != "" {
+		size, err := humanize.ParseBytes(maxSize)
+		if err != nil {
+			return fmt.Errorf("Unable to parse --max-object-size %s: %v", maxSize, err)
+		}
+		globalContext.MaxObjectSize = int64(size)
+	}
+	if lowSpace := ctxString(c, "staging-low-space"); lowSpace != "" {
+		size, err := humanize.ParseBytes(lowSpace)
+		if err != nil {
+			return fmt.Errorf("Unable to parse --staging-low-space %s: %v", lowSpace, err)
+		}
+		globalContext.StagingLowSpace = size
+	}
 	globalContext.NotifyClnt = &http.Client{
-		Transport: &http.Transport{
+		Transport: &recyclingTransport{lifetime: notifyConnLifetime, Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
@@ -89,7 +392,7 @@ func setGlobalsFromContext(c *cli.Context) error {
 			MaxIdleConns:          256,
 			MaxIdleConnsPerHost:   16,
 			ResponseHeaderTimeout: time.Minute,
-			IdleConnTimeout:       time.Minute,
+			IdleConnTimeout:       notifyIdleConnTimeout,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 10 * time.Second,
 			// Set this value so that the underlying transport round-tripper
@@ -106,7 +409,7 @@ func setGlobalsFromContext(c *cli.Context) error {
 				MinVersion: tls.VersionTLS12,
 				RootCAs:    globalContext.RootCAs,
 			},
-		},
+		}},
 	}
 
 	return nil
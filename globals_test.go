@@ -0,0 +1,95 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	testCases := []struct {
+		endpoint    string
+		assumeHTTPS bool
+		want        string // empty when the endpoint is rejected
+		wantErr     string
+	}{
+		// Bare hostnames.
+		{endpoint: "minio.lan", assumeHTTPS: true, want: "https://minio.lan"},
+		{endpoint: "areal.endpoint.lan", assumeHTTPS: true, want: "https://areal.endpoint.lan"},
+		{endpoint: "minio.lan", wantErr: "scheme is missing"},
+		{endpoint: "  minio.lan  ", assumeHTTPS: true, want: "https://minio.lan"},
+
+		// IP:port, parsed as an opaque URL without the https default.
+		{endpoint: "myhost:9000", assumeHTTPS: true, want: "https://myhost:9000"},
+		{endpoint: "10.0.0.1:9000", assumeHTTPS: true, want: "https://10.0.0.1:9000"},
+		{endpoint: "[::1]:9000", assumeHTTPS: true, want: "https://[::1]:9000"},
+		{endpoint: "10.0.0.1:9000", wantErr: "scheme is missing"},
+
+		// Scheme-prefixed URLs.
+		{endpoint: "http://minio.lan:9000", want: "http://minio.lan:9000"},
+		{endpoint: "https://minio.lan", want: "https://minio.lan"},
+		{endpoint: "https://minio.lan/s3/", want: "https://minio.lan/s3/"},
+
+		// Invalid.
+		{endpoint: "", wantErr: "not set"},
+		{endpoint: "ftp://minio.lan", wantErr: "scheme must be http, https or unix"},
+		{endpoint: "https://", wantErr: "host is missing"},
+		{endpoint: "https://:9000", wantErr: "host is missing"},
+		{endpoint: "https://minio.lan?x=1", wantErr: "query and fragment"},
+		{endpoint: "https://minio lan", wantErr: "Invalid MinIO endpoint"},
+		{endpoint: "unix://", wantErr: "absolute path of a socket"},
+		{endpoint: "unix:///nonexistent/minio.sock", wantErr: "no such file"},
+	}
+	for _, tc := range testCases {
+		u, err := parseEndpoint(tc.endpoint, tc.assumeHTTPS)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%q: expected error containing %q, got %v", tc.endpoint, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.endpoint, err)
+			continue
+		}
+		if u.String() != tc.want {
+			t.Errorf("%q: expected %s, got %s", tc.endpoint, tc.want, u)
+		}
+	}
+}
+
+func TestParseEndpointSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "minio.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	if _, err := parseEndpoint("unix://"+sock, false); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Not a socket.
+	dir := filepath.Dir(sock)
+	if _, err := parseEndpoint("unix://"+dir, false); err == nil || !strings.Contains(err.Error(), "is not a unix socket") {
+		t.Errorf("expected a not a socket error, got %v", err)
+	}
+}
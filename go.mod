@@ -13,6 +13,7 @@ require (
 	github.com/minio/cli v1.24.2
 	github.com/minio/minio-go/v7 v7.0.63
 	github.com/minio/pkg/v2 v2.0.2
+	github.com/robfig/cron/v3 v3.0.1
 	gopkg.in/yaml.v2 v2.4.0
 )
 
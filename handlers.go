@@ -18,17 +18,18 @@
 package main
 
 import (
-	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,7 +37,6 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
 var errNotifyEpRequired = errors.New("a notification endpoint is required")
@@ -81,6 +81,28 @@ func writeSuccessResponse(w http.ResponseWriter, data interface{}, sync bool) {
 	sresp.Render(w)
 }
 
+// operationCreated - LXD status code of async operations, returned in
+// `status_code` of the body. It is not an HTTP status code, the HTTP
+// status of async responses is 202 Accepted as with LXD.
+const operationCreated = 100
+
+// writeAsyncResponse - responds to requests that started an operation
+// running in the background.
+func writeAsyncResponse(w http.ResponseWriter, data interface{}) {
+	sresp := &successResponse{
+		Metadata: data,
+		Status:   "Operation created",
+		Code:     operationCreated,
+		Type:     AsyncResponse,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(sresp)
+}
+
 // NotFound returns a not found response (404) with the given error.
 func NotFound(err error) *errorResponse {
 	message := "not found"
@@ -95,6 +117,49 @@ func NotFound(err error) *errorResponse {
 	}
 }
 
+// Unauthorized returns an unauthorized response (401) with the given error.
+func Unauthorized(err error) *errorResponse {
+	message := "unauthorized"
+	if err != nil {
+		message = err.Error()
+	}
+
+	return &errorResponse{
+		Code:  http.StatusUnauthorized,
+		Error: message,
+		Type:  ErrorResponse,
+	}
+}
+
+// Conflict returns a conflict response (409) with the given error.
+func Conflict(err error) *errorResponse {
+	message := "conflict"
+	if err != nil {
+		message = err.Error()
+	}
+
+	return &errorResponse{
+		Code:  http.StatusConflict,
+		Error: message,
+		Type:  ErrorResponse,
+	}
+}
+
+// ServiceUnavailable returns a service unavailable response (503) with the
+// given error.
+func ServiceUnavailable(err error) *errorResponse {
+	message := "service unavailable"
+	if err != nil {
+		message = err.Error()
+	}
+
+	return &errorResponse{
+		Code:  http.StatusServiceUnavailable,
+		Error: message,
+		Type:  ErrorResponse,
+	}
+}
+
 type errorResponse struct {
 	Code  int          `json:"code"`
 	Error string       `json:"error"`
@@ -142,14 +207,51 @@ type backupInfo struct {
 	Optimized  *bool             `json:"optimized,omitempty"`
 	Compressed *bool             `json:"compressed,omitempty"`
 	Tags       map[string]string `json:"tags,omitempty"`
+	Encrypted  string            `json:"encrypted,omitempty"`
+	SHA256     string            `json:"sha256,omitempty"`
+	URI        string            `json:"uri,omitempty"`
+	Class      string            `json:"storageClass,omitempty"`
+	Snapshots  *bool             `json:"snapshots,omitempty"` // nil if not recorded
 	State      string            `json:"state,omitempty"`
 	Progress   *int64            `json:"progress,omitempty"`
+	OpType     string            `json:"opType,omitempty"`     // backup or restore in progress
+	Incomplete bool              `json:"incomplete,omitempty"` // interrupted before its manifest was uploaded
+
+	// RetentionMode, RetainUntil, LegalHold - active object lock of the
+	// instance backup.
+	RetentionMode string     `json:"retentionMode,omitempty"`
+	RetainUntil   *time.Time `json:"retainUntil,omitempty"`
+	LegalHold     bool       `json:"legalHold,omitempty"`
+
+	// Versions, VersionsSize - number and total size of the versions of
+	// the instance backup, only when requested.
+	Versions     *int   `json:"versions,omitempty"`
+	VersionsSize *int64 `json:"versionsSize,omitempty"`
+
+	// Key - object key of the instance backup, only for display.
+	Key string `json:"-"`
+}
+
+// setObjectLock - sets the object lock of the backup, an expired
+// retention is left out.
+func (bi *backupInfo) setObjectLock(lock objectLock) {
+	if lock.retained() {
+		bi.RetentionMode = lock.Mode
+		bi.RetainUntil = lock.RetainUntil
+	}
+	bi.LegalHold = lock.LegalHold
 }
 
 type backupReader struct {
+	Instance string
 	Started  bool
 	Size     int64
 	Progress int64
+
+	// Reported on shutdown with an interrupted notification.
+	StartedAt      time.Time
+	NotifyEndpoint string
+	RawURL         string
 }
 
 func (bk *backupReader) Read(b []byte) (int, error) {
@@ -157,51 +259,189 @@ func (bk *backupReader) Read(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// backupState - backups in progress by `instance/backup`, backup names
+// only have a resolution of a second and backups of several instances
+// may start within the same second.
 type backupState struct {
 	sync.RWMutex
 	backups map[string]*backupReader
 }
 
-func (s *backupState) Store(bname string, rk *backupReader) {
+func (s *backupState) Store(key string, rk *backupReader) {
 	s.Lock()
 	defer s.Unlock()
 
-	s.backups[bname] = rk
+	s.backups[key] = rk
 }
 
-func (s *backupState) Pop(bname string) {
+func (s *backupState) Pop(key string) {
 	s.Lock()
 	defer s.Unlock()
 
-	delete(s.backups, bname)
+	delete(s.backups, key)
+}
+
+func (s *backupState) Get(key string) *backupReader {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.backups[key]
 }
 
-func (s *backupState) Get(bname string) *backupReader {
+// Running - returns true if a backup for the instance is in progress.
+func (s *backupState) Running(instance string) bool {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.backups[bname]
+	return s.running(instance) > 0
+}
+
+// running - returns the number of backups of the instance in progress,
+// the caller must hold the lock.
+func (s *backupState) running(instance string) (n int) {
+	for _, rk := range s.backups {
+		if rk.Instance == instance {
+			n++
+		}
+	}
+	return n
+}
+
+// tryStore - records the backup as in progress unless check, called under
+// the lock with the number of backups of the instance in progress, refuses
+// it. Concurrent requests are checked one after the other, so that they
+// cannot both pass a check before either is recorded. check must not
+// block, e.g. on a listing, while every other request waits for the lock.
+func (s *backupState) tryStore(key string, rk *backupReader, check func(running int) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := check(s.running(rk.Instance)); err != nil {
+		return err
+	}
+	s.backups[key] = rk
+	return nil
+}
+
+// conflictErr - a backup refused because of the backups of the instance,
+// rendered as 409 Conflict.
+type conflictErr struct {
+	error
+}
+
+// interrupt - sends an interrupted notification for each backup still in
+// progress, so that receivers do not wait for a completion that never
+// comes once the service exits.
+func (s *backupState) interrupt() {
+	s.RLock()
+	events := make([]eventInfo, 0, len(s.backups))
+	endpoints := make([]string, 0, len(s.backups))
+	for key, rk := range s.backups {
+		startedAt := rk.StartedAt
+		events = append(events, eventInfo{
+			OpType:    Backup,
+			State:     Interrupted,
+			Name:      path.Base(key),
+			Instance:  rk.Instance,
+			StartedAt: &startedAt,
+			RawURL:    rk.RawURL,
+		})
+		endpoints = append(endpoints, rk.NotifyEndpoint)
+	}
+	s.RUnlock()
+
+	interruptedAt := time.Now()
+	for i, e := range events {
+		e.FailedAt = &interruptedAt
+		notifyEvent(e, endpoints[i])
+	}
 }
 
 var globalBackupState = &backupState{
 	backups: map[string]*backupReader{},
 }
 
-func performBackup(instance, backupName string, tagsMap map[string]string, partSize int64, startedAt time.Time, notifyEndpoint string, r *http.Request) error {
+// restoreProgress - progress of a restore started over the REST API, the
+// bytes downloaded from MinIO are written to it.
+type restoreProgress struct {
+	Instance string
+	Size     int64 // bytes to download, without a streamed instance backup
+	Progress int64
+}
+
+func (rp *restoreProgress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&rp.Progress, int64(len(b)))
+	return len(b), nil
+}
+
+// restoreState - restores in progress by `instance/backup`, a backup may
+// be restored on several instances at once.
+type restoreState struct {
+	sync.RWMutex
+	restores map[string]*restoreProgress
+}
+
+func (s *restoreState) Store(key string, rp *restoreProgress) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.restores[key] = rp
+}
+
+func (s *restoreState) Pop(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.restores, key)
+}
+
+func (s *restoreState) Get(key string) *restoreProgress {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.restores[key]
+}
+
+var globalRestoreState = &restoreState{
+	restores: map[string]*restoreProgress{},
+}
+
+// globalReadOnly - when set, the REST API rejects mutating requests.
+var globalReadOnly atomic.Bool
+
+var errReadOnly = errors.New("lxmin is in read-only mode, backup, restore and delete are disabled")
+
+// readOnlyHandler - rejects the request with 503 while in read-only mode.
+func readOnlyHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if globalReadOnly.Load() {
+			ServiceUnavailable(errReadOnly).Render(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func performBackup(instance, backupName string, bopts backupOpts, startedAt time.Time, notifyEndpoint, rawURL string) error {
 	notifyEvent(eventInfo{
 		OpType:    Backup,
 		State:     Started,
 		Name:      backupName,
 		Instance:  instance,
 		StartedAt: &startedAt,
-		RawURL:    r.URL.String(),
+		RawURL:    rawURL,
 	}, notifyEndpoint)
 
-	bkReader := &backupReader{Started: true}
-	globalBackupState.Store(backupName, bkReader)
-	defer globalBackupState.Pop(backupName)
-
-	// Export profiles to files.
+	bkReader := &backupReader{
+		Instance:       instance,
+		Started:        true,
+		StartedAt:      startedAt,
+		NotifyEndpoint: notifyEndpoint,
+		RawURL:         rawURL,
+	}
+	stateKey := path.Join(instance, backupName)
+	globalBackupState.Store(stateKey, bkReader)
+	defer globalBackupState.Pop(stateKey)
 
 	profiles, err := listProfiles(instance)
 	if err != nil {
@@ -212,30 +452,28 @@ func performBackup(instance, backupName string, tagsMap map[string]string, partS
 		return fmt.Errorf("More than a 1000 profiles per instance not supported.")
 	}
 
-	prInfo := make(map[string]profileInfo, len(profiles))
-	for pno, profile := range profiles {
-		// Profiles are numbered because their order matters - settings
-		// in the later profiles override those from earlier profiles.
-		profileFile := fmt.Sprintf("%s_profile_%03d_%s.yaml", backupName, pno, profile)
-		profilePath := path.Join(globalContext.StagingRoot, profileFile)
-
-		prSize, err := exportProfile(profile, profilePath)
-		if err != nil {
+	var volumes []storageVolume
+	if bopts.Volumes {
+		if volumes, err = listVolumes(instance); err != nil {
 			return err
 		}
+	}
 
-		prInfo[profile] = profileInfo{
-			FileName: profileFile,
-			Size:     prSize,
-		}
+	// Remove everything staged for this backup, wherever it fails.
+	bkp := bopts.newBackup(instance, backupName)
+	staged, err := stagedFiles(globalContext, bkp, profiles, volumes)
+	if err != nil {
+		return err
 	}
+	defer removeStaged(staged)
 
 	// Export instance to tarball
 
-	instanceBkpFilename := backupName + "_instance.tar.gz"
-	localPath := path.Join(globalContext.StagingRoot, instanceBkpFilename)
-	optimized := r.Form.Get("optimize") == "true"
-	instanceSize, err := exportInstance(instance, localPath, optimized)
+	localPath, err := globalContext.stagingPath(path.Base(bkp.key()))
+	if err != nil {
+		return err
+	}
+	instanceSize, err := exportInstance(instance, localPath, bopts)
 	if err != nil {
 		return err
 	}
@@ -243,19 +481,11 @@ func performBackup(instance, backupName string, tagsMap map[string]string, partS
 	// Upload instance tarball to MinIO.
 
 	bkReader.Size = instanceSize
-	globalBackupState.Store(backupName, bkReader)
-
-	usermetadata := map[string]string{}
-	// Save additional information if the backup is optimized or not.
-	usermetadata["optimized"] = strconv.FormatBool(optimized)
-	usermetadata["compressed"] = "true" // This is always true.
+	globalBackupState.Store(stateKey, bkReader)
 
-	opts := minio.PutObjectOptions{
-		UserTags:     tagsMap,
-		PartSize:     uint64(partSize),
-		UserMetadata: usermetadata,
-		ContentType:  mime.TypeByExtension(".tar.gz"),
-		Progress:     bkReader,
+	sum, err := fileSHA256(localPath)
+	if err != nil {
+		return fmt.Errorf("Unable to checksum instance backup %s: %v", localPath, err)
 	}
 
 	f, err := os.Open(localPath)
@@ -263,42 +493,38 @@ func performBackup(instance, backupName string, tagsMap map[string]string, partS
 		return err
 	}
 	defer f.Close()
-	defer os.Remove(localPath)
 
-	bkp := backup{instance: instance, backupName: backupName}
-	_, err = globalContext.Clnt.PutObject(context.Background(), globalContext.Bucket, bkp.key(), f, instanceSize, opts)
-	if err != nil {
+	if err = globalContext.putIncompleteMarker(bkp); err != nil {
+		return err
+	}
+	if err = globalContext.putInstanceBackup(bkp, bopts, f, instanceSize, sum, bkReader); err != nil {
 		return err
 	}
 
-	// Upload profiles to MinIO.
-	for _, profile := range profiles {
-		err := func() error {
-			profileFile := prInfo[profile].FileName
-			size := prInfo[profile].Size
-			fpath := path.Join(globalContext.StagingRoot, profileFile)
-			f, err := os.Open(fpath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			defer os.Remove(fpath)
+	// Export and upload profiles to MinIO.
+	manifest, err := backupProfiles(globalContext, bopts, instance, backupName, profiles, nil)
+	if err != nil {
+		return err
+	}
+	manifest.Volumes, err = backupVolumes(globalContext, bopts, instance, backupName, volumes, nil)
+	if err != nil {
+		return err
+	}
+	if err = globalContext.putManifest(bkp, bopts, manifest); err != nil {
+		return err
+	}
+	if err = globalContext.removeIncompleteMarker(bkp); err != nil {
+		return err
+	}
 
-			opts := minio.PutObjectOptions{
-				UserTags:    tagsMap,
-				PartSize:    uint64(partSize),
-				ContentType: mime.TypeByExtension(".yaml"),
-			}
-			_, err = globalContext.Clnt.PutObject(context.Background(), globalContext.Bucket, path.Join(instance, profileFile), f, size, opts)
-			if err != nil {
-				return fmt.Errorf("Error uploading file %s: %v", fpath, err)
-			}
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
+	uploaded := instanceSize
+	for _, pf := range manifest.Profiles {
+		uploaded += pf.Size
+	}
+	for _, vol := range manifest.Volumes {
+		uploaded += vol.Size
 	}
+	globalMetrics.bytesUploaded.Add(uploaded)
 
 	completedAt := time.Now()
 	notifyEvent(eventInfo{
@@ -308,7 +534,12 @@ func performBackup(instance, backupName string, tagsMap map[string]string, partS
 		Instance:    instance,
 		StartedAt:   &startedAt,
 		CompletedAt: &completedAt,
-		RawURL:      r.URL.String(),
+		RawURL:      rawURL,
+		Size:        instanceSize,
+		Optimized:   bopts.Optimized,
+		Tags:        bopts.TagsSet.ToMap(),
+		Bucket:      globalContext.Bucket,
+		ObjectKey:   bkp.key(),
 	}, notifyEndpoint)
 	return err
 }
@@ -323,36 +554,78 @@ func performRestore(instance, backupName string, startedAt time.Time, notifyEndp
 		RawURL:    r.URL.String(),
 	}, notifyEndpoint)
 
-	bkp := backup{instance: instance, backupName: backupName}
+	bkp := globalContext.resolveBackup(backup{instance: instance, backupName: backupName})
+
+	progress := &restoreProgress{Instance: instance}
+	globalRestoreState.Store(bkp.prefix(), progress)
+	defer globalRestoreState.Pop(bkp.prefix())
+
+	if r.Form.Get("force") != "true" {
+		if err := globalContext.checkComplete(bkp); err != nil {
+			return err
+		}
+	}
 
 	// Fetch restore info
-	resInfo, err := globalContext.fetchRestoreInfo(bkp)
+	resInfo, err := globalContext.fetchRestoreInfo(bkp, r.Form.Get("allowMissingProfiles") == "true")
 	if err != nil {
 		return err
 	}
-
-	// Download profiles
-	for _, pkey := range resInfo.profileKeys {
-		err := globalContext.downloadItem(pkey, nil)
-		if err != nil {
-			return fmt.Errorf("Error downloading profile file %s: %v", pkey, err)
+	if len(resInfo.missing) > 0 {
+		log.Printf("Profiles missing from backup %s of instance '%s', they can not be restored: %s", backupName, instance, strings.Join(resInfo.missing, ", "))
+	}
+	pool := r.Form.Get("storage")
+	if ei, err := inspectExport(globalContext, bkp); err != nil {
+		log.Println(err)
+	} else {
+		if err := ei.checkOptimized(bkp, resInfo.optimized); err != nil {
+			log.Println(err)
+		}
+		if err := ei.checkPool(bkp, pool); err != nil {
+			log.Println(err)
 		}
 	}
 
-	// Download instance backup
-	if err := globalContext.downloadItem(bkp.key(), nil); err != nil {
-		return fmt.Errorf("Error downloading instance backup %s: %v", bkp.key(), err)
+	if r.Form.Get("skipProfiles") == "true" {
+		expected := resInfo.skipProfiles()
+		log.Printf("Skipping profiles restore for instance '%s', expected profiles: %s", instance, strings.Join(expected, ", "))
+	}
+
+	// A streamed instance backup is not downloaded.
+	stream := r.Form.Get("stream") == "true" && resInfo.streamable()
+	progress.Size = resInfo.totalSize
+	if stream {
+		progress.Size -= resInfo.instanceSize
+	}
+	globalRestoreState.Store(bkp.prefix(), progress)
+
+	// Download profiles and storage volumes
+	if err := globalContext.downloadProfiles(resInfo, nil, progress); err != nil {
+		return err
+	}
+	if err := globalContext.downloadVolumes(resInfo, nil, progress); err != nil {
+		return err
+	}
+
+	// Download instance backup, unless it is piped into 'lxc import'.
+	if !stream {
+		if err := globalContext.downloadItem(bkp.key(), nil, progress, false); err != nil {
+			return fmt.Errorf("Error downloading instance backup %s: %v", bkp.key(), err)
+		}
 	}
+	globalMetrics.bytesDownloaded.Add(resInfo.totalSize)
 
 	// Fetch existing profiles on the system
-	existingProfiles, err := fetchExistingProfiles()
+	remote, _ := splitRemote(instance)
+	project := r.Form.Get("toProject")
+	existingProfiles, err := fetchExistingProfiles(remote, project)
 	if err != nil {
 		return err
 	}
 
 	// Restore profiles - skip those that already exist.
 	for i, pf := range resInfo.profiles {
-		err := restoreProfile(globalContext, pf, resInfo.profileKeys[i], existingProfiles)
+		err := restoreProfile(globalContext, pf, resInfo.profileKeys[i], remote, project, existingProfiles, r.Form.Get("verifyProfiles") == "true", r.Form.Get("overwriteProfiles") == "true")
 		if _, ok := err.(warnMsgErr); ok {
 			// Skip warning that profile was not replaced for now.
 			continue
@@ -361,8 +634,28 @@ func performRestore(instance, backupName string, startedAt time.Time, notifyEndp
 		}
 	}
 
+	// Restore storage volumes before the instance that attaches them.
+	for i, mv := range resInfo.volumes {
+		err := restoreVolume(globalContext, mv.volume(), resInfo.volumeKeys[i], remote, project)
+		if _, ok := err.(warnMsgErr); ok {
+			log.Printf("Skipping storage volume %s/%s of instance '%s' as it already exists", mv.Pool, mv.Name, instance)
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
 	// Restore instance
-	_, err = restoreInstance(globalContext, bkp)
+	iopts := importOpts{
+		project: project,
+		pool:    pool,
+		start:   r.Form.Get("importStopped") != "true" && r.Form.Get("noStart") != "true",
+	}
+	if stream {
+		_, err = streamInstance(globalContext, bkp, iopts, nil)
+	} else {
+		_, err = restoreInstance(globalContext, bkp, iopts)
+	}
 	if err != nil {
 		return err
 	}
@@ -377,6 +670,8 @@ func performRestore(instance, backupName string, startedAt time.Time, notifyEndp
 		StartedAt:   &startedAt,
 		CompletedAt: &completedAt,
 		RawURL:      r.URL.String(),
+		Size:        resInfo.totalSize,
+		Optimized:   resInfo.optimized,
 	}, notifyEndpoint)
 
 	return nil
@@ -397,11 +692,32 @@ func restoreHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := checkInstance(instance); err != nil {
+	if err := validateNames(instance, backup); err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
+	if project := r.Form.Get("toProject"); project != "" {
+		remote, _ := splitRemote(instance)
+		if err := ensureProject(remote+project, r.Form.Get("createProject") == "true"); err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+	}
+
+	if err := checkInstance(instance, r.Form.Get("toProject")); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	if pool := r.Form.Get("storage"); pool != "" {
+		remote, _ := splitRemote(instance)
+		if strings.Contains(pool, ":") || !storagePoolExists(remote+pool) {
+			writeErrorResponse(w, fmt.Errorf("storage pool '%s' does not exist", pool))
+			return
+		}
+	}
+
 	notifyEndpoint, err := url.QueryUnescape(r.Form.Get("notifyEndpoint"))
 	if err != nil {
 		writeErrorResponse(w, errors.New("invalid notifyEndpoint"))
@@ -412,7 +728,7 @@ func restoreHandler(w http.ResponseWriter, r *http.Request) {
 		notifyEndpoint = globalContext.NotifyEndpoint
 	}
 
-	if notifyEndpoint == "" {
+	if notifyEndpoint == "" && globalEvents == nil {
 		writeErrorResponse(w, errNotifyEpRequired)
 		return
 	}
@@ -435,16 +751,7 @@ func restoreHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	sresp := &successResponse{
-		Status: "Operation created",
-		Code:   100,
-		Type:   AsyncResponse,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-
-	json.NewEncoder(w).Encode(sresp)
+	writeAsyncResponse(w, nil)
 }
 
 func backupHandler(w http.ResponseWriter, r *http.Request) {
@@ -456,6 +763,11 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateNames(instance, ""); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
 	partSize, err := strconv.ParseInt(r.Form.Get("partSize"), 10, 64)
 	if err != nil && r.Form.Get("partSize") != "" {
 		writeErrorResponse(w, err)
@@ -465,7 +777,35 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 		partSize = 64 * humanize.MiByte
 	}
 
-	tagsSet, err := tags.Parse(r.Form.Get("tags"), true)
+	tagsSet, err := parseBackupTags(r.Form.Get("tags"), r.Form["tag"])
+	if err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	var compressLevel int
+	if level := r.Form.Get("compressLevel"); level != "" {
+		compressLevel, err = strconv.Atoi(level)
+		if err == nil {
+			_, err = compressionArg("gzip", compressLevel)
+		}
+		if err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+	}
+
+	uncompressed, err := parseCompression(r.Form.Get("compression"), compressLevel, nil)
+	if err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	retentionMode := r.Form.Get("retentionMode")
+	if retentionMode == "" {
+		retentionMode = string(minio.Governance)
+	}
+	mode, retainUntil, err := parseRetention(r.Form.Get("retainUntil"), retentionMode)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
@@ -481,15 +821,69 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 		notifyEndpoint = globalContext.NotifyEndpoint
 	}
 
-	if notifyEndpoint == "" {
+	if notifyEndpoint == "" && globalEvents == nil {
 		writeErrorResponse(w, errNotifyEpRequired)
 		return
 	}
 
+	// Existing backups are listed before the backup state is locked, a
+	// slow listing must not hold up every other request.
+	maxBackups := globalContext.MaxBackupsPerInstance
+	var stored int
+	if maxBackups > 0 {
+		backups, err := globalContext.ListBackups(instance)
+		if err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+		stored = len(backups)
+	}
+
+	// The backup is recorded as in progress before responding, backups
+	// in progress count towards the maximum number of backups.
 	backup := "backup_" + time.Now().Format("2006-01-02-15-0405")
+	failIfRunning := r.Form.Get("failIfRunning") == "true"
+	startedAt := time.Now()
+	err = globalBackupState.tryStore(path.Join(instance, backup), &backupReader{
+		Instance:       instance,
+		StartedAt:      startedAt,
+		NotifyEndpoint: notifyEndpoint,
+		RawURL:         r.URL.String(),
+	}, func(running int) error {
+		if failIfRunning && running > 0 {
+			return conflictErr{fmt.Errorf("a backup for instance '%s' is already in progress", instance)}
+		}
+		if maxBackups > 0 && stored+running >= maxBackups {
+			return conflictErr{fmt.Errorf("instance '%s' already has the maximum of %d backups", instance, maxBackups)}
+		}
+		return nil
+	})
+	if err != nil {
+		var conflict conflictErr
+		if errors.As(err, &conflict) {
+			Conflict(err).Render(w)
+			return
+		}
+		writeErrorResponse(w, err)
+		return
+	}
+
 	go func() {
-		startedAt := time.Now()
-		if err := performBackup(instance, backup, tagsSet.ToMap(), partSize, startedAt, notifyEndpoint, r); err != nil {
+		bopts := backupOpts{
+			TagsSet:       tagsSet,
+			PartSize:      partSize,
+			Optimized:     r.Form.Get("optimize") == "true",
+			CompressLevel: compressLevel,
+			RetentionMode: mode,
+			RetainUntil:   retainUntil,
+			LegalHold:     r.Form.Get("legalHold") == "true",
+			StorageClass:  r.Form.Get("storageClass"),
+			InstanceOnly:  r.Form.Get("instanceOnly") == "true",
+			GzipProfiles:  r.Form.Get("compressOnUpload") == "true",
+			Volumes:       r.Form.Get("volumes") == "true",
+			Uncompressed:  uncompressed,
+		}
+		if err := performBackup(instance, backup, bopts, startedAt, notifyEndpoint, r.URL.String()); err != nil {
 			failedAt := time.Now()
 			notifyEvent(eventInfo{
 				OpType:    Backup,
@@ -506,23 +900,13 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	optimized := r.Form.Get("optimize") == "true"
-	compressed := true
-
-	sresp := &successResponse{
-		Metadata: backupInfo{
-			Name:       backup,
-			Optimized:  &optimized,
-			Compressed: &compressed,
-		},
-		Status: "Operation created",
-		Code:   100,
-		Type:   AsyncResponse,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
+	compressed := !uncompressed
 
-	json.NewEncoder(w).Encode(sresp)
+	writeAsyncResponse(w, backupInfo{
+		Name:       backup,
+		Optimized:  &optimized,
+		Compressed: &compressed,
+	})
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -540,18 +924,23 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateNames(instance, backupName); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
 	bkp := backup{
 		instance:   instance,
 		backupName: backupName,
 	}
 
-	err := globalContext.DeleteBackup(bkp)
+	di, err := globalContext.DeleteBackup(bkp)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	writeSuccessResponse(w, nil, true)
+	writeSuccessResponse(w, di, true)
 }
 
 func infoHandler(w http.ResponseWriter, r *http.Request) {
@@ -569,7 +958,12 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if reader := globalBackupState.Get(backupName); reader != nil {
+	if err := validateNames(instance, backupName); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	if reader := globalBackupState.Get(path.Join(instance, backupName)); reader != nil {
 		state := "generating"
 		progress := atomic.LoadInt64(&reader.Progress)
 		if reader.Started && progress > 0 {
@@ -580,29 +974,43 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 			Size:     reader.Size,
 			State:    state,
 			Progress: &progress,
+			OpType:   Backup,
 		}, true)
 		return
 	}
 
-	bkp := backup{
+	if rp := globalRestoreState.Get(path.Join(instance, backupName)); rp != nil {
+		progress := atomic.LoadInt64(&rp.Progress)
+		writeSuccessResponse(w, backupInfo{
+			Instance: instance,
+			Name:     backupName,
+			Size:     rp.Size,
+			State:    "restoring",
+			Progress: &progress,
+			OpType:   Restore,
+		}, true)
+		return
+	}
+
+	bkp := globalContext.resolveBackup(backup{
 		instance:   instance,
 		backupName: backupName,
-	}
+	})
 
-	tags, err := globalContext.GetTags(bkp)
+	meta, err := globalContext.GetMetadata(bkp)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	meta, err := globalContext.GetMetadata(bkp)
+	tags, err := globalContext.GetTags(bkp)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
 
-	optimized := meta.UserMetadata["Optimized"] == "true"
-	compressed := meta.UserMetadata["Compressed"] == "true"
+	optimized := metaValue(meta.UserMetadata, metaOptimized) == "true"
+	compressed := metaValue(meta.UserMetadata, metaCompressed) == "true"
 
 	info := backupInfo{
 		Name:       backupName,
@@ -611,7 +1019,12 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 		Optimized:  &optimized,
 		Compressed: &compressed,
 		Tags:       tags.ToMap(),
+		Encrypted:  meta.Encryption,
+		SHA256:     meta.SHA256,
+		Class:      meta.StorageClass,
+		Snapshots:  parseSnapshots(metaValue(meta.UserMetadata, metaSnapshots)),
 	}
+	info.setObjectLock(meta.Lock)
 
 	writeSuccessResponse(w, info, true)
 }
@@ -630,19 +1043,197 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		instance = ""
 	}
 
+	if err := validateNames(instance, ""); err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+
+	var limit int
+	if l := r.Form.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeErrorResponse(w, fmt.Errorf("invalid limit '%s', expected a positive number", l))
+			return
+		}
+		limit = n
+	}
+
+	var tagFilter map[string]string
+	if len(r.Form["tag"]) > 0 {
+		tagsSet, err := parseBackupTags("", r.Form["tag"])
+		if err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+		tagFilter = tagsSet.ToMap()
+	}
+
 	backups, err := globalContext.ListBackups(instance)
 	if err != nil {
 		writeErrorResponse(w, err)
 		return
 	}
+	if r.Form.Get("showUri") == "true" {
+		for i := range backups {
+			backups[i].URI = globalContext.backupURI(backups[i].Key)
+		}
+	}
+
+	marker := r.Form.Get("marker")
+	if limit == 0 && marker == "" {
+		if tagFilter != nil {
+			if backups, _, err = pageBackups(backups, nil, 0, tagFilter); err != nil {
+				writeErrorResponse(w, err)
+				return
+			}
+		}
+		writeSuccessResponse(w, backups, true)
+		return
+	}
+
+	var after *listMarker
+	if marker != "" {
+		if after, err = parseListMarker(marker); err != nil {
+			writeErrorResponse(w, err)
+			return
+		}
+	}
+
+	page, next, err := pageBackups(backups, after, limit, tagFilter)
+	if err != nil {
+		writeErrorResponse(w, err)
+		return
+	}
+	writeSuccessResponse(w, backupListPage{Backups: page, NextMarker: next}, true)
+}
+
+// backupListPage - response of the list API when paginated with `limit`
+// or `marker`, without them all backups are returned as a plain list.
+type backupListPage struct {
+	Backups    []backupInfo `json:"backups"`
+	NextMarker string       `json:"nextMarker,omitempty"`
+}
+
+// listMarker - position in the listing sorted by creation time, the key
+// orders backups created at the same time. Markers stay valid when the
+// backups they point at are deleted.
+type listMarker struct {
+	created time.Time
+	key     string
+}
+
+func (m listMarker) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(m.created.UnixNano(), 10) + "/" + m.key))
+}
+
+func parseListMarker(s string) (*listMarker, error) {
+	errInvalid := fmt.Errorf("invalid marker '%s'", s)
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+	ns, key, ok := strings.Cut(string(buf), "/")
+	if !ok {
+		return nil, errInvalid
+	}
+	n, err := strconv.ParseInt(ns, 10, 64)
+	if err != nil {
+		return nil, errInvalid
+	}
+	return &listMarker{created: time.Unix(0, n), key: key}, nil
+}
+
+func (m listMarker) before(b backupInfo) bool {
+	if !m.created.Equal(*b.Created) {
+		return m.created.Before(*b.Created)
+	}
+	return m.key < b.Key
+}
+
+// pageBackups - returns up to limit backups after the marker sorted by
+// creation time, 0 for no limit, and the marker of the next page. With
+// tagFilter only backups with all of these tags are returned, tags are
+// fetched only for the backups examined for this page. The next marker
+// is returned whenever backups remain to be examined, so the last page
+// may be empty.
+func pageBackups(backups []backupInfo, after *listMarker, limit int, tagFilter map[string]string) ([]backupInfo, string, error) {
+	sort.Slice(backups, func(i, j int) bool {
+		return listMarker{created: *backups[i].Created, key: backups[i].Key}.before(backups[j])
+	})
+
+	page := []backupInfo{}
+	for i, bkp := range backups {
+		if after != nil && !after.before(bkp) {
+			continue
+		}
+		if limit > 0 && len(page) == limit {
+			prev := backups[i-1]
+			return page, listMarker{created: *prev.Created, key: prev.Key}.String(), nil
+		}
+		if tagFilter != nil {
+			ok, err := matchTags(bkp, tagFilter)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+		page = append(page, bkp)
+	}
+	return page, "", nil
+}
+
+// matchTags - reports if the backup has all the tags, the tags are fetched
+// when the listing did not return them.
+func matchTags(bkp backupInfo, tagFilter map[string]string) (bool, error) {
+	bkpTags := bkp.Tags
+	if len(bkpTags) == 0 {
+		t, err := globalContext.GetTags(backup{instance: bkp.Instance, backupName: bkp.Name, uncompressed: strings.HasSuffix(bkp.Key, plainInstanceSuffix)})
+		if err != nil {
+			return false, err
+		}
+		bkpTags = t.ToMap()
+	}
+	for k, v := range tagFilter {
+		if bkpTags[k] != v {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// diskFree - free space of the filesystem holding a directory, replaced
+// in tests.
+var diskFree = statfsFree
+
+// stagingFree - free space on the staging root.
+func stagingFree() (uint64, error) {
+	stagingRoot := globalContext.StagingRoot
+	if stagingRoot == "" {
+		stagingRoot = "."
+	}
+	return diskFree(stagingRoot)
+}
 
-	writeSuccessResponse(w, backups, true)
+type healthInfo struct {
+	StagingFree     uint64 `json:"staging_free"`
+	StagingLowSpace bool   `json:"staging_low_space"`
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	// A very simple health check.
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// A very simple health check, additionally reports free space on
+	// the staging root so capacity problems surface before a backup
+	// fails.
+	free, err := stagingFree()
+	if err != nil {
+		// Not fatal for health, just skip reporting staging usage.
+		writeSuccessResponse(w, nil, true)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	writeSuccessResponse(w, healthInfo{
+		StagingFree:     free,
+		StagingLowSpace: free < globalContext.StagingLowSpace,
+	}, true)
 }
@@ -0,0 +1,523 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// serveTest - serves the request with the REST API routes.
+func serveTest(t *testing.T, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	newRouter(false).ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeMetadata - decodes the metadata of a success response into v.
+func decodeMetadata(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	resp := struct {
+		Metadata json.RawMessage `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(resp.Metadata, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func backupNames(backups []backupInfo) []string {
+	names := make([]string, 0, len(backups))
+	for _, b := range backups {
+		names = append(names, b.Instance+"/"+b.Name)
+	}
+	return names
+}
+
+func TestListHandler(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default"}})
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b2", profiles: []string{"default"}})
+	putTestBackup(t, ms, testBackup{instance: "u2", name: "b1"})
+
+	testCases := []struct {
+		target string
+		want   []string
+	}{
+		{"/1.0/instances/u1/backups", []string{"u1/b2", "u1/b1"}},
+		{"/1.0/instances/u2/backups", []string{"u2/b1"}},
+		{"/1.0/instances/*/backups", []string{"u2/b1", "u1/b2", "u1/b1"}},
+		{"/1.0/instances/u3/backups", []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			var backups []backupInfo
+			decodeMetadata(t, serveTest(t, http.MethodGet, tc.target), &backups)
+			if got := backupNames(backups); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestListHandlerPaginated(t *testing.T) {
+	ms := newTestContext(t)
+	for _, name := range []string{"b1", "b2", "b3"} {
+		putTestBackup(t, ms, testBackup{instance: "u1", name: name})
+	}
+
+	var page backupListPage
+	decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/instances/u1/backups?limit=2"), &page)
+	if got, want := backupNames(page.Backups), []string{"u1/b1", "u1/b2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if page.NextMarker == "" {
+		t.Fatal("expected a next marker")
+	}
+
+	var next backupListPage
+	decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/instances/u1/backups?limit=2&marker="+page.NextMarker), &next)
+	if got, want := backupNames(next.Backups), []string{"u1/b3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if next.NextMarker != "" {
+		t.Fatalf("expected no next marker, got %s", next.NextMarker)
+	}
+
+	if rec := serveTest(t, http.MethodGet, "/1.0/instances/u1/backups?limit=0"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid limit, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", data: "tarball", bopts: backupOpts{Optimized: true}})
+
+	var info backupInfo
+	decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/instances/u1/backups/b1"), &info)
+	if info.Name != "b1" || info.Size != int64(len("tarball")) {
+		t.Errorf("unexpected backup info %+v", info)
+	}
+	if info.Optimized == nil || !*info.Optimized {
+		t.Error("expected the backup to be optimized")
+	}
+	if info.Compressed == nil || !*info.Compressed {
+		t.Error("expected the backup to be compressed")
+	}
+	if info.SHA256 != sha256Hex([]byte("tarball")) {
+		t.Errorf("unexpected checksum %s", info.SHA256)
+	}
+
+	if rec := serveTest(t, http.MethodGet, "/1.0/instances/u1/backups/missing"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a missing backup, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if rec := serveTest(t, http.MethodGet, "/1.0/instances/u1/backups/b1_profile_x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid backup name, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default", "web"}})
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b2", profiles: []string{"default"}})
+
+	var di deleteInfo
+	decodeMetadata(t, serveTest(t, http.MethodDelete, "/1.0/instances/u1/backups/b1"), &di)
+	if want := []string{"b1"}; !reflect.DeepEqual(di.Backups, want) {
+		t.Errorf("expected deleted backups %v, got %v", want, di.Backups)
+	}
+	// The instance tarball, two profiles and the manifest.
+	if di.Objects != 4 {
+		t.Errorf("expected 4 deleted objects, got %d", di.Objects)
+	}
+
+	want := []string{
+		"u1/b2_instance.tar.gz",
+		"u1/b2_manifest.json",
+		"u1/b2_profile_000_default.yaml",
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected remaining objects %v, got %v", want, got)
+	}
+}
+
+func TestHandlerUnauthorized(t *testing.T) {
+	newTestContext(t)
+	req := httptest.NewRequest(http.MethodGet, "/1.0/instances/u1/backups", nil)
+	rec := httptest.NewRecorder()
+	newRouter(false).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+// blockBackups - makes backups started over the REST API wait until the
+// returned function is called, they then fail on the fake lxc.
+func blockBackups(t *testing.T) (release func()) {
+	t.Helper()
+	done := filepath.Join(t.TempDir(), "done")
+	fakeLXC(t, "while [ ! -e "+done+" ]; do sleep 0.01; done\nexit 1\n")
+
+	prev := globalEvents
+	events := &eventLog{}
+	globalEvents = events
+	t.Cleanup(func() { globalEvents = prev })
+
+	release = func() {
+		os.WriteFile(done, nil, 0o644)
+		// Wait for every backup to be done and to report its failure,
+		// before the test context goes.
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			states := map[string]int{}
+			for _, raw := range events.list() {
+				var e eventInfo
+				json.Unmarshal(raw, &e)
+				states[e.State]++
+			}
+			if globalBackupState.Len() == 0 && states[Started] == states[Failed] {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("backups still running")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	t.Cleanup(release)
+	return release
+}
+
+// serveConcurrently - serves n identical requests at once, returns the
+// number of responses per status code.
+func serveConcurrently(t *testing.T, n int, method, target string) map[int]int {
+	t.Helper()
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = map[int]int{}
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := serveTest(t, method, target)
+			mu.Lock()
+			codes[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return codes
+}
+
+func TestBackupHandlerAsyncResponse(t *testing.T) {
+	newTestContext(t)
+	release := blockBackups(t)
+
+	// LXD's operation convention, HTTP 202 with the "Operation created"
+	// status code in the body.
+	rec := serveTest(t, http.MethodPost, "/1.0/instances/u1/backups")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type application/json, got %q", ct)
+	}
+	var resp struct {
+		Type       ResponseType `json:"type"`
+		Status     string       `json:"status"`
+		StatusCode int          `json:"status_code"`
+		Metadata   backupInfo   `json:"metadata"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != AsyncResponse || resp.Status != "Operation created" || resp.StatusCode != 100 {
+		t.Errorf("expected an async operation created response, got %s", rec.Body)
+	}
+	if resp.Metadata.Name == "" {
+		t.Errorf("expected the backup name, got %s", rec.Body)
+	}
+	release()
+}
+
+func TestBackupHandlerFailIfRunning(t *testing.T) {
+	newTestContext(t)
+	release := blockBackups(t)
+
+	codes := serveConcurrently(t, 10, http.MethodPost, "/1.0/instances/u1/backups?failIfRunning=true")
+	if codes[http.StatusAccepted] != 1 || codes[http.StatusConflict] != 9 {
+		t.Fatalf("expected a single backup to start, got %v", codes)
+	}
+	if !globalBackupState.Running("u1") {
+		t.Fatal("expected a backup of u1 in progress")
+	}
+
+	// Other instances are not affected.
+	if rec := serveTest(t, http.MethodPost, "/1.0/instances/u2/backups?failIfRunning=true"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+
+	release()
+	if rec := serveTest(t, http.MethodPost, "/1.0/instances/u1/backups?failIfRunning=true"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d once the backup is done, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+}
+
+func TestBackupHandlerMaxBackups(t *testing.T) {
+	ms := newTestContext(t)
+	globalContext.MaxBackupsPerInstance = 3
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b2"})
+	release := blockBackups(t)
+
+	// Below the cap only one of the concurrent backups may start, the
+	// backup in progress counts towards the cap.
+	codes := serveConcurrently(t, 10, http.MethodPost, "/1.0/instances/u1/backups")
+	if codes[http.StatusAccepted] != 1 || codes[http.StatusConflict] != 9 {
+		t.Fatalf("expected a single backup to start, got %v", codes)
+	}
+	release()
+
+	// At the cap.
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b3"})
+	rec := serveTest(t, http.MethodPost, "/1.0/instances/u1/backups")
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status %d at the cap, got %d: %s", http.StatusConflict, rec.Code, rec.Body)
+	}
+
+	// Other instances have their own cap.
+	if rec := serveTest(t, http.MethodPost, "/1.0/instances/u2/backups"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+}
+
+// slowListStore - blocks the first listing until unblock is closed.
+type slowListStore struct {
+	*memStore
+	once    sync.Once
+	listing chan struct{}
+	unblock chan struct{}
+}
+
+func (s *slowListStore) List(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	s.once.Do(func() {
+		close(s.listing)
+		<-s.unblock
+	})
+	return s.memStore.List(ctx, opts)
+}
+
+func TestBackupHandlerSlowListing(t *testing.T) {
+	ms := newTestContext(t)
+	globalContext.MaxBackupsPerInstance = 3
+	release := blockBackups(t)
+	sl := &slowListStore{memStore: ms, listing: make(chan struct{}), unblock: make(chan struct{})}
+	globalContext.Store = sl
+
+	result := make(chan *httptest.ResponseRecorder, 1)
+	go func() { result <- serveTest(t, http.MethodPost, "/1.0/instances/u1/backups") }()
+	<-sl.listing
+
+	// Counting the existing backups does not hold the backup state.
+	locked := make(chan struct{})
+	go func() {
+		globalBackupState.Running("u1")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		close(sl.unblock)
+		t.Fatal("backup state is locked while listing backups")
+	}
+
+	close(sl.unblock)
+	if rec := <-result; rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	release()
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+	globalReadOnly.Store(true)
+	t.Cleanup(func() { globalReadOnly.Store(false) })
+
+	for _, tc := range []struct {
+		method, target string
+	}{
+		{http.MethodPost, "/1.0/instances/u1/backups"},
+		{http.MethodPost, "/1.0/instances/u1/backups/b1"},
+		{http.MethodDelete, "/1.0/instances/u1/backups/b1"},
+	} {
+		if rec := serveTest(t, tc.method, tc.target); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tc.method, tc.target, http.StatusServiceUnavailable, rec.Code, rec.Body)
+		}
+	}
+	if got := ms.keys(); len(got) != 2 {
+		t.Errorf("expected the backup to be kept, got %v", got)
+	}
+
+	for _, target := range []string{
+		"/1.0/instances/u1/backups",
+		"/1.0/instances/u1/backups/b1",
+		"/1.0/health",
+	} {
+		if rec := serveTest(t, http.MethodGet, target); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: expected status %d, got %d: %s", target, http.StatusOK, rec.Code, rec.Body)
+		}
+	}
+
+	globalReadOnly.Store(false)
+	if rec := serveTest(t, http.MethodDelete, "/1.0/instances/u1/backups/b1"); rec.Code != http.StatusOK {
+		t.Errorf("expected status %d once writable, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+}
+
+// fakeDiskFree - replaces statfs with a fixed result for the duration of
+// the test.
+func fakeDiskFree(t *testing.T, free uint64, err error) {
+	t.Helper()
+	prev := diskFree
+	diskFree = func(dir string) (uint64, error) { return free, err }
+	t.Cleanup(func() { diskFree = prev })
+}
+
+func TestHealthHandler(t *testing.T) {
+	newTestContext(t)
+	globalContext.StagingLowSpace = 10 << 30
+
+	testCases := []struct {
+		name string
+		free uint64
+		want healthInfo
+	}{
+		{"healthy", 20 << 30, healthInfo{StagingFree: 20 << 30}},
+		{"low space", 1 << 30, healthInfo{StagingFree: 1 << 30, StagingLowSpace: true}},
+	}
+	for _, tc := range testCases {
+		fakeDiskFree(t, tc.free, nil)
+		var got healthInfo
+		decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/health"), &got)
+		if got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+
+		rec := serveTest(t, http.MethodGet, "/metrics")
+		if want := fmt.Sprintf("lxmin_staging_free_bytes %d\n", tc.free); !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: expected metric %q, got %s", tc.name, want, rec.Body)
+		}
+	}
+}
+
+func TestHealthHandlerLowSpaceDisabled(t *testing.T) {
+	newTestContext(t)
+	fakeDiskFree(t, 0, nil)
+
+	var got healthInfo
+	decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/health"), &got)
+	if got.StagingLowSpace {
+		t.Errorf("expected no low space warning with a 0 threshold, got %+v", got)
+	}
+}
+
+func TestHealthHandlerStatfsError(t *testing.T) {
+	newTestContext(t)
+	fakeDiskFree(t, 0, errors.New("statfs failed"))
+
+	rec := serveTest(t, http.MethodGet, "/1.0/health")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "staging_free") {
+		t.Errorf("expected no staging usage, got %s", rec.Body)
+	}
+	if rec := serveTest(t, http.MethodGet, "/metrics"); strings.Contains(rec.Body.String(), "lxmin_staging_free_bytes") {
+		t.Errorf("expected no staging metric, got %s", rec.Body)
+	}
+}
+
+func TestBackupStateInstances(t *testing.T) {
+	s := &backupState{backups: map[string]*backupReader{}}
+	s.Store("u1/backup_2024-01-01-00-0000", &backupReader{Instance: "u1"})
+	s.Store("u2/backup_2024-01-01-00-0000", &backupReader{Instance: "u2"})
+
+	// Backups of other instances started in the same second are kept.
+	s.Pop("u1/backup_2024-01-01-00-0000")
+	if rk := s.Get("u2/backup_2024-01-01-00-0000"); rk == nil || rk.Instance != "u2" {
+		t.Fatalf("expected the backup of u2 in progress, got %+v", rk)
+	}
+	if s.Running("u1") || !s.Running("u2") {
+		t.Fatalf("expected only u2 to be running, got %v", s.backups)
+	}
+}
+
+func TestBackupHandlerInstances(t *testing.T) {
+	newTestContext(t)
+	release := blockBackups(t)
+
+	names := map[string]string{}
+	for _, instance := range []string{"u1", "u2"} {
+		rec := serveTest(t, http.MethodPost, "/1.0/instances/"+instance+"/backups")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+		}
+		var resp struct {
+			Metadata backupInfo `json:"metadata"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		names[instance] = resp.Metadata.Name
+	}
+
+	if n := globalBackupState.Len(); n != 2 {
+		t.Fatalf("expected 2 backups in progress, got %d", n)
+	}
+	for instance, name := range names {
+		var bi backupInfo
+		decodeMetadata(t, serveTest(t, http.MethodGet, "/1.0/instances/"+instance+"/backups/"+name), &bi)
+		if bi.State == "" {
+			t.Errorf("%s: expected backup %s in progress, got %+v", instance, name, bi)
+		}
+	}
+	release()
+}
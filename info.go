@@ -18,19 +18,36 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/dustin/go-humanize"
 	"github.com/minio/cli"
 )
 
+var infoFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "overwrite-metadata",
+		Usage: "rewrite the backup metadata in place with the current scheme before printing",
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the backup info as a JSON object",
+	},
+	cli.BoolFlag{
+		Name:  "show-versions-count",
+		Usage: "show the number and total size of the versions of the backup, for versioned buckets",
+	},
+}
+
 var infoCmd = cli.Command{
 	Name:   "info",
 	Usage:  "pretty print tags on an instance image on MinIO",
 	Action: infoMain,
 	Before: setGlobalsFromContext,
-	Flags:  globalFlags,
+	Flags:  append(infoFlags, globalFlags...),
 	CustomHelpTemplate: `NAME:
   {{.HelpName}} - {{.Usage}}
 
@@ -43,6 +60,12 @@ FLAGS:
 EXAMPLES:
   1. Pretty print tags for a backup 'backup_2022-02-16-04-1040' for instance 'u2':
      {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040
+  2. Repair the metadata of an older backup 'backup_2022-02-16-04-1040' for instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --overwrite-metadata
+  3. Print the info of backup 'backup_2022-02-16-04-1040' for instance 'u2' as JSON:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --json
+  4. Show how many versions of backup 'backup_2022-02-16-04-1040' for instance 'u2' are stored:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --show-versions-count
 `,
 }
 
@@ -56,29 +79,96 @@ func infoMain(c *cli.Context) error {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
 
+	if instance == "*" {
+		return errWildcardInstance
+	}
+
 	backupName := strings.TrimSpace(c.Args().Get(1))
 	if backupName == "" {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
 
-	bkp := backup{instance: instance, backupName: backupName}
+	if err := validateNames(instance, backupName); err != nil {
+		return err
+	}
 
-	tags, err := globalContext.GetTags(bkp)
+	bkp := globalContext.resolveBackup(backup{instance: instance, backupName: backupName})
+
+	if c.Bool("overwrite-metadata") {
+		if err := globalContext.OverwriteMetadata(bkp); err != nil {
+			return fmt.Errorf("Unable to overwrite metadata for backup %s: %v", backupName, err)
+		}
+	}
+
+	meta, err := globalContext.GetMetadata(bkp)
 	if err != nil {
 		return err
 	}
 
-	meta, err := globalContext.GetMetadata(bkp)
+	tags, err := globalContext.GetTags(bkp)
 	if err != nil {
 		return err
 	}
 
+	var versions *int
+	var versionsSize *int64
+	if c.Bool("show-versions-count") {
+		count, size, err := globalContext.CountVersions(bkp)
+		if err != nil {
+			return fmt.Errorf("Unable to count versions of backup %s: %v", backupName, err)
+		}
+		versions, versionsSize = &count, &size
+	}
+
+	if c.Bool("json") {
+		optimized := metaValue(meta.UserMetadata, metaOptimized) == "true"
+		compressed := metaValue(meta.UserMetadata, metaCompressed) == "true"
+		info := backupInfo{
+			Instance:   instance,
+			Name:       backupName,
+			Created:    &meta.LastModified,
+			Size:       meta.Size,
+			Optimized:  &optimized,
+			Compressed: &compressed,
+			Tags:       tags.ToMap(),
+			Encrypted:  meta.Encryption,
+			SHA256:     meta.SHA256,
+			Class:      meta.StorageClass,
+			Snapshots:  parseSnapshots(metaValue(meta.UserMetadata, metaSnapshots)),
+
+			Versions:     versions,
+			VersionsSize: versionsSize,
+		}
+		info.setObjectLock(meta.Lock)
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+
 	var msgBuilder strings.Builder
 	// Format properly for alignment based on maxKey leng
 	backupName = fmt.Sprintf("%-10s: %s", "Name", backupName)
 	msgBuilder.WriteString(backupName + "\n")
 	msgBuilder.WriteString(fmt.Sprintf("%-10s: %s ", "Date", meta.LastModified.Format(printDate)) + "\n")
 	msgBuilder.WriteString(fmt.Sprintf("%-10s: %-6s ", "Size", humanize.IBytes(uint64(meta.Size))) + "\n")
+	if meta.Encryption != "" {
+		encryption := meta.Encryption
+		if meta.KMSKeyID != "" {
+			encryption += " (key: " + meta.KMSKeyID + ")"
+		}
+		msgBuilder.WriteString(fmt.Sprintf("%-10s: %s ", "Encryption", encryption) + "\n")
+	}
+	msgBuilder.WriteString(fmt.Sprintf("%-10s: %s ", "Class", meta.StorageClass) + "\n")
+	if meta.SHA256 != "" {
+		msgBuilder.WriteString(fmt.Sprintf("%-10s: %s ", "SHA-256", meta.SHA256) + "\n")
+	}
+	if meta.Lock.retained() {
+		msgBuilder.WriteString(fmt.Sprintf("%-10s: %s until %s", "Retention", strings.ToLower(meta.Lock.Mode), meta.Lock.RetainUntil.Format(printDate)) + "\n")
+	}
+	if meta.Lock.LegalHold {
+		msgBuilder.WriteString(fmt.Sprintf("%-10s: %s", "Legal hold", "on") + "\n")
+	}
+	if versions != nil {
+		msgBuilder.WriteString(fmt.Sprintf("%-10s: %d (%s total)", "Versions", *versions, humanize.IBytes(uint64(*versionsSize))) + "\n")
+	}
 
 	maxTagsKey := 0
 	for k := range tags.ToMap() {
@@ -87,15 +177,21 @@ func infoMain(c *cli.Context) error {
 		}
 	}
 
+	metadata := map[string]string{}
+	for name, key := range map[string]string{
+		"Compressed": metaCompressed,
+		"Optimized":  metaOptimized,
+		"Snapshots":  metaSnapshots,
+	} {
+		if v := metaValue(meta.UserMetadata, key); v != "" {
+			metadata[name] = v
+		}
+	}
+
 	maxKeyMetadata := 0
-	for k := range meta.UserMetadata {
-		if !strings.HasPrefix(strings.ToLower(k), serverEncryptionKeyPrefix) {
-			switch k {
-			case "Optimized", "Compressed":
-				if len(k) > maxKeyMetadata {
-					maxKeyMetadata = len(k)
-				}
-			}
+	for k := range metadata {
+		if len(k) > maxKeyMetadata {
+			maxKeyMetadata = len(k)
 		}
 	}
 
@@ -113,20 +209,13 @@ func infoMain(c *cli.Context) error {
 
 	if maxKeyMetadata > 0 {
 		msgBuilder.WriteString(fmt.Sprintf("%-10s:", "Metadata") + "\n")
-		for k, v := range meta.UserMetadata {
-			if !strings.HasPrefix(strings.ToLower(k), serverEncryptionKeyPrefix) {
-				switch k {
-				case "Compressed", "Optimized":
-					if v == "true" {
-						v = tickCell
-					} else {
-						v = crossTickCell
-					}
-				default:
-					continue
-				}
-				msgBuilder.WriteString(fmt.Sprintf("  %-*.*s : %s ", maxKeyMetadata, maxKeyMetadata, k, v) + "\n")
+		for k, v := range metadata {
+			if v == "true" {
+				v = tickCell
+			} else {
+				v = crossTickCell
 			}
+			msgBuilder.WriteString(fmt.Sprintf("  %-*.*s : %s ", maxKeyMetadata, maxKeyMetadata, k, v) + "\n")
 		}
 	}
 
@@ -0,0 +1,34 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestInfoWildcardInstance(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+
+	if err := runCommand(t, infoCmd, "*", "b1"); err != errWildcardInstance {
+		t.Errorf("expected %v, got %v", errWildcardInstance, err)
+	}
+	if err := runCommand(t, infoCmd, "--json", "u1", "b1"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -18,21 +18,62 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
 	"strings"
+	"text/template"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/dustin/go-humanize"
 	"github.com/minio/cli"
 )
 
+var listFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "full-keys",
+		Usage: "show the raw object key of each backup, useful for debugging",
+	},
+	cli.StringFlag{
+		Name:  "save-listing",
+		Usage: "save the listed backups as JSON to this file, for a later '--since-backup'",
+	},
+	cli.StringFlag{
+		Name:  "since-backup",
+		Usage: "only list backups new, deleted or changed since the listing saved in this file",
+	},
+	cli.StringFlag{
+		Name:  "template",
+		Usage: "print each backup with this Go template instead of a table, e.g. '{{.Name}}\\t{{.Size}}'",
+	},
+	cli.StringFlag{
+		Name:  "filter-instance",
+		Usage: "when listing all instances, only list instances whose name matches this regular expression",
+	},
+	cli.StringFlag{
+		Name:  "sort",
+		Value: sortByCreated,
+		Usage: "sort backups by 'created' (newest first), 'name' or 'size' (largest first)",
+	},
+	cli.BoolFlag{
+		Name:  "reverse",
+		Usage: "reverse the sort order",
+	},
+	cli.BoolFlag{
+		Name:  "show-uri",
+		Usage: "show the s3:// URI of each backup, e.g. to copy it with 'mc' or 'aws s3'",
+	},
+}
+
 var listCmd = cli.Command{
 	Name:    "list",
 	Aliases: []string{"ls"},
 	Usage:   "list all backups from MinIO",
 	Action:  listMain,
 	Before:  setGlobalsFromContext,
-	Flags:   globalFlags,
+	Flags:   append(listFlags, globalFlags...),
 	CustomHelpTemplate: `NAME:
   {{.HelpName}} - {{.Usage}}
 
@@ -47,6 +88,18 @@ EXAMPLES:
      {{.Prompt}} {{.HelpName}}
   2. List all backups by instance name 'u2':
      {{.Prompt}} {{.HelpName}} u2
+  3. List all backups along with their object keys:
+     {{.Prompt}} {{.HelpName}} --full-keys
+  4. List backups changed since the previous run, saving the current listing for the next one:
+     {{.Prompt}} {{.HelpName}} --since-backup listing.json --save-listing listing.json
+  5. List only the names and sizes of the backups of instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2 --template '{{"{{"}}.Name{{"}}"}}\t{{"{{"}}.Size{{"}}"}}'
+  6. List backups of all instances named 'web-' followed by a number:
+     {{.Prompt}} {{.HelpName}} --filter-instance '^web-[0-9]+$'
+  7. List the backups of instance 'u2', smallest first:
+     {{.Prompt}} {{.HelpName}} u2 --sort size --reverse
+  8. List the S3 URIs of the backups of instance 'u2', one per line:
+     {{.Prompt}} {{.HelpName}} u2 --show-uri --template '{{"{{"}}.URI{{"}}"}}'
 `,
 }
 
@@ -55,7 +108,7 @@ const (
 	crossTickCell string = "✗ "
 )
 
-var subtle = lipgloss.AdaptiveColor{Light: "#D9DCCF", Dark: "#383838"}
+var subtleColor = lipgloss.AdaptiveColor{Light: "#D9DCCF", Dark: "#383838"}
 
 func listMain(c *cli.Context) error {
 	if len(c.Args()) > 1 {
@@ -63,12 +116,49 @@ func listMain(c *cli.Context) error {
 	}
 
 	instance := strings.TrimSpace(c.Args().Get(0))
+	// Allow '*' for all backups, same as the REST API.
+	if instance == "*" {
+		instance = ""
+	}
+	if err := validateNames(instance, ""); err != nil {
+		return err
+	}
+
+	sortBy := c.String("sort")
+	switch sortBy {
+	case sortByCreated, sortByName, sortBySize:
+	default:
+		return fmt.Errorf("Invalid --sort '%s', expected one of %s, %s or %s", sortBy, sortByCreated, sortByName, sortBySize)
+	}
+
+	var instanceRe *regexp.Regexp
+	if expr := c.String("filter-instance"); expr != "" {
+		if instance != "" {
+			return errors.New("--filter-instance is only supported when listing all instances")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("Invalid --filter-instance: %v", err)
+		}
+		instanceRe = re
+	}
+
+	var rowTmpl *template.Template
+	if tmpl := c.String("template"); tmpl != "" {
+		// Allow '\t' and '\n' as typed in a shell.
+		tmpl = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(tmpl)
+		t, err := template.New("row").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("Invalid --template: %v", err)
+		}
+		rowTmpl = t
+	}
 
 	var table strings.Builder
 
 	list := lipgloss.NewStyle().
 		BorderStyle(lipgloss.NormalBorder()).
-		BorderForeground(subtle)
+		BorderForeground(subtleColor)
 
 	listHeader := lipgloss.NewStyle().
 		PaddingLeft(1).
@@ -85,18 +175,69 @@ func listMain(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if instanceRe != nil {
+		backups = filterInstances(backups, instanceRe)
+	}
+	sortBackups(backups, sortBy, c.Bool("reverse"))
+	if c.Bool("show-uri") {
+		for i := range backups {
+			backups[i].URI = globalContext.backupURI(backups[i].Key)
+		}
+	}
+
+	rows := backups
+	var changes []string
+	if fpath := c.String("since-backup"); fpath != "" {
+		saved, err := loadListing(fpath)
+		if err != nil {
+			return err
+		}
+		rows, changes = diffListing(saved, backups)
+	}
+
+	if fpath := c.String("save-listing"); fpath != "" {
+		if err := saveListing(fpath, backups); err != nil {
+			return err
+		}
+	}
+
+	if rowTmpl != nil {
+		for _, bkp := range rows {
+			if err := rowTmpl.Execute(os.Stdout, bkp); err != nil {
+				return fmt.Errorf("Unable to render --template: %v", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
 
 	data := map[string][]string{}
-	for _, bkp := range backups {
+	data["Change"] = changes
+	for _, bkp := range rows {
 		data["Instance"] = append(data["Instance"], bkp.Instance)
-		data["Name"] = append(data["Name"], bkp.Name)
+		if bkp.Incomplete {
+			data["Name"] = append(data["Name"], bkp.Name+" (incomplete)")
+		} else {
+			data["Name"] = append(data["Name"], bkp.Name)
+		}
+		data["Key"] = append(data["Key"], bkp.Key)
+		data["URI"] = append(data["URI"], bkp.URI)
 		data["Created"] = append(data["Created"], bkp.Created.Format(printDate))
 		data["Size"] = append(data["Size"], humanize.IBytes(uint64(bkp.Size)))
+		data["Class"] = append(data["Class"], bkp.Class)
 		if *bkp.Optimized {
 			data["Optimized"] = append(data["Optimized"], tickCell)
 		} else {
 			data["Optimized"] = append(data["Optimized"], crossTickCell)
 		}
+		switch {
+		case bkp.Snapshots == nil:
+			data["Snapshots"] = append(data["Snapshots"], "-")
+		case *bkp.Snapshots:
+			data["Snapshots"] = append(data["Snapshots"], tickCell)
+		default:
+			data["Snapshots"] = append(data["Snapshots"], crossTickCell)
+		}
 	}
 
 	items := func(header string) []string {
@@ -108,8 +249,20 @@ func listMain(c *cli.Context) error {
 		return itemRenders
 	}
 
+	headers := []string{"Instance", "Name", "Created", "Size", "Class", "Optimized", "Snapshots"}
+	if c.String("since-backup") != "" {
+		headers = append([]string{"Change"}, headers...)
+	}
+	if c.Bool("full-keys") {
+		headers = append(headers, "Key")
+	}
+	if c.Bool("show-uri") {
+		headers = append(headers, "URI")
+		fmt.Printf("ⓘ Endpoint: %s\n", globalContext.Endpoint)
+	}
+
 	renderLists := []string{}
-	for _, header := range []string{"Instance", "Name", "Created", "Size", "Optimized"} {
+	for _, header := range headers {
 		renderLists = append(renderLists, list.Render(lipgloss.JoinVertical(lipgloss.Left, items(header)...)))
 	}
 	lists := lipgloss.JoinHorizontal(lipgloss.Top, renderLists...)
@@ -119,3 +272,75 @@ func listMain(c *cli.Context) error {
 	fmt.Println(docStyle.Render(table.String()))
 	return nil
 }
+
+// saveListing - saves the backups as JSON, to be compared against by a
+// later `--since-backup`.
+func saveListing(fpath string, backups []backupInfo) error {
+	buf, err := json.MarshalIndent(backups, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fpath, buf, 0o644); err != nil {
+		return fmt.Errorf("Unable to save listing to %s: %v", fpath, err)
+	}
+	return nil
+}
+
+func loadListing(fpath string) ([]backupInfo, error) {
+	buf, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read listing %s: %v", fpath, err)
+	}
+	var backups []backupInfo
+	if err := json.Unmarshal(buf, &backups); err != nil {
+		return nil, fmt.Errorf("Unable to parse listing %s: %v", fpath, err)
+	}
+	return backups, nil
+}
+
+// diffListing - returns the backups that are new, deleted or changed in
+// size or creation time since the saved listing, along with the change.
+func diffListing(saved, current []backupInfo) (rows []backupInfo, changes []string) {
+	listingKey := func(bkp backupInfo) string {
+		return bkp.Instance + "/" + bkp.Name
+	}
+
+	previous := make(map[string]backupInfo, len(saved))
+	for _, bkp := range saved {
+		previous[listingKey(bkp)] = bkp
+	}
+
+	for _, bkp := range current {
+		old, ok := previous[listingKey(bkp)]
+		delete(previous, listingKey(bkp))
+		switch {
+		case !ok:
+			changes = append(changes, "new")
+		case old.Size != bkp.Size || old.Created == nil || !old.Created.Equal(*bkp.Created):
+			changes = append(changes, "changed")
+		default:
+			continue
+		}
+		rows = append(rows, bkp)
+	}
+
+	// Whatever remains of the saved listing no longer exists.
+	for _, bkp := range saved {
+		if _, ok := previous[listingKey(bkp)]; ok {
+			changes = append(changes, "deleted")
+			rows = append(rows, bkp)
+		}
+	}
+	return rows, changes
+}
+
+// filterInstances - keeps the backups of instances matching re.
+func filterInstances(backups []backupInfo, re *regexp.Regexp) []backupInfo {
+	var filtered []backupInfo
+	for _, bkp := range backups {
+		if re.MatchString(bkp.Instance) {
+			filtered = append(filtered, bkp)
+		}
+	}
+	return filtered
+}
@@ -18,26 +18,33 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/minio/cli"
 	"github.com/minio/minio-go/v7/pkg/set"
 	"gopkg.in/yaml.v2"
 )
 
-const (
-	printDate                 = "2006-01-02 15:04:05 MST"
-	serverEncryptionKeyPrefix = "x-amz-server-side-encryption"
-)
+const printDate = "2006-01-02 15:04:05 MST"
 
 type cmdSpinnerUI struct {
 	spinner    spinner.Model
@@ -46,10 +53,14 @@ type cmdSpinnerUI struct {
 	warningMsg string
 	cmdFn      func() tea.Msg
 	opts       cOpts
+	startedAt  time.Time
 }
 
 type cOpts struct {
 	instance, message string
+	// showElapsed - append time spent so far, for long running commands
+	// that cannot report progress.
+	showElapsed bool
 }
 
 func (m *cmdSpinnerUI) Init() tea.Cmd {
@@ -102,7 +113,16 @@ func (m *cmdSpinnerUI) View() string {
 		m.opts.message += "\n"
 	}
 
-	return fmt.Sprintf(m.opts.message, spin, m.opts.instance)
+	msg := fmt.Sprintf(m.opts.message, spin, m.opts.instance)
+	if m.opts.showElapsed {
+		elapsed := fmt.Sprintf(" (%s)", time.Since(m.startedAt).Round(time.Second))
+		if strings.HasSuffix(msg, "\n") {
+			msg = strings.TrimSuffix(msg, "\n") + elapsed + "\n"
+		} else {
+			msg += elapsed
+		}
+	}
+	return msg
 }
 
 type warningMessage struct {
@@ -114,9 +134,10 @@ func initCmdSpinnerUI(fn func() tea.Msg, opts cOpts) *cmdSpinnerUI {
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 	return &cmdSpinnerUI{
-		spinner: s,
-		cmdFn:   fn,
-		opts:    opts,
+		spinner:   s,
+		cmdFn:     fn,
+		opts:      opts,
+		startedAt: time.Now(),
 	}
 }
 
@@ -186,16 +207,131 @@ func initSpinnerUI(opts lxcOpts) *spinnerUI {
 	}
 }
 
+// lxcBinary - client used to manage instances, `lxc` for LXD and
+// `incus` for Incus. Both share the same command line for everything
+// lxmin needs, only the binary name differs.
+var lxcBinary = "lxc"
+
+// lxcTimeout - kills lxc commands running longer than this, 0 lets them
+// run forever.
+var lxcTimeout time.Duration
+
+// errLXCTimeout - an lxc command was killed after `--lxc-timeout`.
+var errLXCTimeout = errors.New("lxc command timed out")
+
+// setLXCOptions - selects the client binary based on the `--incus` flag,
+// before or after the command name, and the timeout of its commands based
+// on `--lxc-timeout`. Fails when the client is not installed.
+func setLXCOptions(c *cli.Context) error {
+	if ctxBool(c, "incus") {
+		lxcBinary = "incus"
+	}
+	lxcTimeout = ctxDuration(c, "lxc-timeout")
+
+	if _, err := exec.LookPath(lxcBinary); err != nil {
+		msg := "lxc CLI not found in PATH; install LXD or use --incus for Incus"
+		if lxcBinary == "incus" {
+			msg = "incus CLI not found in PATH; install Incus or drop --incus for LXD"
+		}
+		return cli.NewExitError(msg, exitCodeLXCNotFound)
+	}
+	return nil
+}
+
+func lxcCommand(args ...string) *exec.Cmd {
+	return exec.Command(lxcBinary, args...)
+}
+
+// runLXC - runs an lxc command, killing it along with the processes it
+// spawned once it runs longer than `--lxc-timeout`.
+func runLXC(cmd *exec.Cmd) error {
+	if lxcTimeout <= 0 {
+		return cmd.Run()
+	}
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var killed atomic.Bool
+	timer := time.AfterFunc(lxcTimeout, func() {
+		killed.Store(true)
+		killProcessGroup(cmd)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if killed.Load() {
+		return fmt.Errorf("%w: '%s' did not finish within %s", errLXCTimeout, strings.Join(cmd.Args, " "), lxcTimeout)
+	}
+	return err
+}
+
+// withStderr - adds the trimmed stderr of a failed lxc command to its
+// error, lxc explains why it failed there and exits with status 1.
+func withStderr(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
+// projectArgs - prefixes lxc arguments with `--project` to run them in
+// the given LXD project, the default project when project is empty.
+func projectArgs(project string, args ...string) []string {
+	if project == "" {
+		return args
+	}
+	return append([]string{"--project", project}, args...)
+}
+
+// projectExists - reports whether the LXD project exists.
+func projectExists(project string) bool {
+	return runLXC(lxcCommand("project", "show", project)) == nil
+}
+
+// ensureProject - checks that the LXD project exists, creating it when
+// create is true.
+func ensureProject(project string, create bool) error {
+	if projectExists(project) {
+		return nil
+	}
+	if !create {
+		return fmt.Errorf("Project %s does not exist, use --create-project to create it", project)
+	}
+	if err := runLXC(lxcCommand("project", "create", project)); err != nil {
+		return fmt.Errorf("Unable to create project %s: %v", project, err)
+	}
+	return nil
+}
+
+// splitRemote - splits an instance of the `remote:instance` form into the
+// `remote:` prefix for lxc and the instance name, the prefix is empty for
+// instances on the local LXD server, as for an empty remote, e.g. `:u1`.
+func splitRemote(instance string) (remote, name string) {
+	i := strings.Index(instance, ":")
+	switch {
+	case i < 0:
+		return "", instance
+	case i == 0:
+		return "", instance[1:]
+	}
+	return instance[:i+1], instance[i+1:]
+}
+
 var instanceExists = errors.New("instance exists")
 
-func checkInstance(instance string) error {
-	var out bytes.Buffer
-	cmd := exec.Command("lxc", "list", instance, "-c", "n", "-f", "csv")
+// checkInstance - fails if the instance exists in the given project.
+func checkInstance(instance, project string) error {
+	_, name := splitRemote(instance)
+	var out, errBuf bytes.Buffer
+	cmd := lxcCommand(projectArgs(project, "list", instance, "-c", "n", "-f", "csv")...)
 	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return err
+	cmd.Stderr = &errBuf
+	if err := runLXC(cmd); err != nil {
+		return withStderr(err, &errBuf)
 	}
-	if strings.TrimSpace(out.String()) == instance {
+	if strings.TrimSpace(out.String()) == name {
 		return fmt.Errorf("'%s' instance is already running by this name: %w", instance, instanceExists)
 	}
 	return nil
@@ -204,12 +340,13 @@ func checkInstance(instance string) error {
 // listProfiles - lists profiles with lxc and returns a list of profile names
 // attached to the given instance.
 func listProfiles(instance string) ([]string, error) {
-	var outBuf bytes.Buffer
-	cmd := exec.Command("lxc", "config", "show", instance)
+	var outBuf, errBuf bytes.Buffer
+	cmd := lxcCommand("config", "show", instance)
 	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
 
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("Unable get instance config: %v", err)
+	if err := runLXC(cmd); err != nil {
+		return nil, fmt.Errorf("Unable get instance config: %w", withStderr(err, &errBuf))
 	}
 
 	type profileInfo struct {
@@ -223,16 +360,51 @@ func listProfiles(instance string) ([]string, error) {
 	return profiles.Profiles, nil
 }
 
+// instanceDiskUsage - returns the disk usage of the instance as reported
+// by lxc, 0 when the storage driver does not report usage.
+func instanceDiskUsage(instance string) (int64, error) {
+	remote, name := splitRemote(instance)
+
+	var outBuf bytes.Buffer
+	cmd := lxcCommand("query", remote+"/1.0/instances/"+name+"/state")
+	cmd.Stdout = &outBuf
+	if err := runLXC(cmd); err != nil {
+		return 0, fmt.Errorf("Unable to get instance state: %v", err)
+	}
+
+	var state struct {
+		Disk map[string]struct {
+			Usage int64 `json:"usage"`
+		} `json:"disk"`
+	}
+	if err := json.Unmarshal(outBuf.Bytes(), &state); err != nil {
+		return 0, fmt.Errorf("Unable to parse instance state: %v", err)
+	}
+
+	var usage int64
+	for _, disk := range state.Disk {
+		usage += disk.Usage
+	}
+	return usage, nil
+}
+
 // exportProfile - exports profile from lxc and saves it at dstPath.
 func exportProfile(profile, dstPath string) (int64, error) {
 	pf, err := os.Create(dstPath)
 	if err != nil {
 		return -1, fmt.Errorf("Unable to create backup file %s: %v", dstPath, err)
 	}
-	cmd := exec.Command("lxc", "profile", "show", profile)
+	var errBuf bytes.Buffer
+	cmd := lxcCommand("profile", "show", profile)
 	cmd.Stdout = pf
-	if err := cmd.Run(); err != nil {
-		return -1, fmt.Errorf("Unable to export profile: %v", err)
+	cmd.Stderr = &errBuf
+	if err := runLXC(cmd); err != nil {
+		if errors.Is(err, errLXCTimeout) {
+			// Do not leave a partial profile behind.
+			pf.Close()
+			os.Remove(dstPath)
+		}
+		return -1, fmt.Errorf("Unable to export profile: %w", withStderr(err, &errBuf))
 	}
 
 	// Sync file to disk
@@ -254,15 +426,104 @@ func exportProfile(profile, dstPath string) (int64, error) {
 	return stat.Size(), nil
 }
 
-func exportInstance(instance, dstFile string, optimized bool) (int64, error) {
-	cmd := exec.Command("lxc", "export", instance, dstFile)
-	if optimized {
-		cmd = exec.Command("lxc", "export", "--optimized-storage", instance, dstFile)
+// compressLevels - valid level range for each compression algorithm
+// accepted by `lxc export --compression`.
+var compressLevels = map[string][2]int{
+	"gzip":  {1, 9},
+	"bzip2": {1, 9},
+	"xz":    {0, 9},
+	"zstd":  {1, 19},
+}
+
+// compressionArg - returns the `--compression` argument for the
+// algorithm at the given level, validating the level is supported.
+func compressionArg(algorithm string, level int) (string, error) {
+	levels, ok := compressLevels[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression algorithm '%s'", algorithm)
+	}
+	if level < levels[0] || level > levels[1] {
+		return "", fmt.Errorf("invalid compression level %d for '%s', must be between %d and %d", level, algorithm, levels[0], levels[1])
+	}
+	return fmt.Sprintf("%s -%d", algorithm, level), nil
+}
+
+// parseCompression - validates the `--compression` of the instance export,
+// returns true for an uncompressed export.
+func parseCompression(compression string, compressLevel int, exportArgs []string) (uncompressed bool, err error) {
+	switch compression {
+	case "", "gzip":
+		return false, nil
+	case "none":
+	default:
+		return false, fmt.Errorf("unsupported compression '%s', must be 'gzip' or 'none'", compression)
+	}
+	if compressLevel > 0 {
+		return false, errors.New("a compression level cannot be combined with an uncompressed export")
+	}
+	for _, arg := range exportArgs {
+		if strings.HasPrefix(arg, "--compression=") {
+			return false, errors.New("--compression in --lxc-export-args cannot be combined with an uncompressed export")
+		}
+	}
+	return true, nil
+}
+
+// exportArgsAllowed - extra `lxc export` arguments accepted with
+// `--lxc-export-args`, anything else is rejected.
+var exportArgsAllowed = []string{"--instance-only", "--optimized-storage", "--compression=gzip", "--compression=none"}
+
+// applyExportArgs - checks the extra `lxc export` arguments against the
+// allowlist and applies them to the backup options, so that the metadata
+// and the object name of the backup match its export.
+func (o *backupOpts) applyExportArgs(args []string) error {
+	for _, arg := range args {
+		switch arg {
+		case "--instance-only":
+			o.InstanceOnly = true
+		case "--optimized-storage":
+			o.Optimized = true
+		case "--compression=gzip":
+		case "--compression=none":
+			if o.CompressLevel > 0 {
+				return errors.New("--compression in --lxc-export-args cannot be combined with --compress-level")
+			}
+			o.Uncompressed = true
+		default:
+			return fmt.Errorf("'%s' is not allowed in --lxc-export-args, allowed: %s", arg, strings.Join(exportArgsAllowed, ", "))
+		}
 	}
+	return nil
+}
+
+func exportInstance(instance, dstFile string, bopts backupOpts) (int64, error) {
+	args := []string{"export"}
+	if bopts.Optimized {
+		args = append(args, "--optimized-storage")
+	}
+	if bopts.Uncompressed {
+		args = append(args, "--compression", "none")
+	} else if bopts.CompressLevel > 0 {
+		compression, err := compressionArg("gzip", bopts.CompressLevel)
+		if err != nil {
+			return -1, err
+		}
+		args = append(args, "--compression", compression)
+	}
+	if bopts.InstanceOnly {
+		args = append(args, "--instance-only")
+	}
+	var errBuf bytes.Buffer
+	cmd := lxcCommand(append(args, instance, dstFile)...)
 	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = &errBuf
 
-	if err := cmd.Run(); err != nil {
-		return -1, fmt.Errorf("Unable to export instance: %v", err)
+	if err := runLXC(cmd); err != nil {
+		if errors.Is(err, errLXCTimeout) {
+			// Do not leave a partial instance backup behind.
+			os.Remove(dstFile)
+		}
+		return -1, fmt.Errorf("Unable to export instance: %w", withStderr(err, &errBuf))
 	}
 
 	s, err := os.Stat(dstFile)
@@ -272,14 +533,18 @@ func exportInstance(instance, dstFile string, optimized bool) (int64, error) {
 	return s.Size(), nil
 }
 
-func fetchExistingProfiles() (s set.StringSet, err error) {
+func fetchExistingProfiles(remote, project string) (s set.StringSet, err error) {
 	// First get the list of existing profiles, so we can restore
 	// only missing ones.
+	args := []string{"profile", "list"}
+	if remote != "" {
+		args = append(args, remote)
+	}
 	var outBuf bytes.Buffer
-	cmd := exec.Command("lxc", "profile", "list", "-f", "yaml")
+	cmd := lxcCommand(projectArgs(project, append(args, "-f", "yaml")...)...)
 	cmd.Stdout = &outBuf
 
-	if err := cmd.Run(); err != nil {
+	if err := runLXC(cmd); err != nil {
 		return s, fmt.Errorf("Unable to list profiles: %v", err)
 	}
 
@@ -307,45 +572,444 @@ func (w warnMsgErr) Error() string {
 	return ""
 }
 
-func restoreProfile(ctx *lxminContext, profile, profileKey string, existingProfiles set.StringSet) error {
-	proPath := path.Join(ctx.StagingRoot, path.Base(profileKey))
+// profileYAML - the parts of `lxc profile show` output that are restored,
+// volatile fields like `used_by` are left out.
+type profileYAML struct {
+	Config      map[string]string            `yaml:"config"`
+	Description string                       `yaml:"description"`
+	Devices     map[string]map[string]string `yaml:"devices"`
+}
 
-	if existingProfiles.Contains(profile) {
+// equal - compares profiles treating missing and empty sections alike.
+func (p profileYAML) equal(o profileYAML) bool {
+	if p.Description != o.Description || len(p.Config) != len(o.Config) || len(p.Devices) != len(o.Devices) {
+		return false
+	}
+	for k, v := range p.Config {
+		if ov, ok := o.Config[k]; !ok || ov != v {
+			return false
+		}
+	}
+	for name, dev := range p.Devices {
+		odev, ok := o.Devices[name]
+		if !ok || len(dev) != len(odev) {
+			return false
+		}
+		for k, v := range dev {
+			if ov, ok := odev[k]; !ok || ov != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validateProfile - parses the staged profile YAML so that a truncated or
+// corrupt profile fails clearly instead of with an opaque lxc error.
+func validateProfile(profile, proPath string) (pf profileYAML, err error) {
+	data, err := os.ReadFile(proPath)
+	if err != nil {
+		return pf, fmt.Errorf("Error reading backup file %s: %v", proPath, err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return pf, fmt.Errorf("Profile %s is corrupt: empty profile", profile)
+	}
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return pf, fmt.Errorf("Profile %s is corrupt: %v", profile, err)
+	}
+	return pf, nil
+}
+
+// verifyProfile - reads back the profile from lxc and checks that it
+// matches the backed up profile, catching a silent `lxc profile edit`.
+func verifyProfile(profile, project string, expected profileYAML) error {
+	var outBuf bytes.Buffer
+	cmd := lxcCommand(projectArgs(project, "profile", "show", profile)...)
+	cmd.Stdout = &outBuf
+	if err := runLXC(cmd); err != nil {
+		return fmt.Errorf("Unable to read back profile %s: %v", profile, err)
+	}
+
+	var applied profileYAML
+	if err := yaml.Unmarshal(outBuf.Bytes(), &applied); err != nil {
+		return fmt.Errorf("Unable to parse profile %s: %v", profile, err)
+	}
+
+	if !expected.equal(applied) {
+		return fmt.Errorf("Profile %s did not apply cleanly, restored profile differs from the backup", profile)
+	}
+	return nil
+}
+
+// restoreProfile - creates the profile from its staged backup. A profile
+// that already exists is skipped with a warning, unless overwrite, then
+// its definition is replaced by the one from the backup.
+func restoreProfile(ctx *lxminContext, profile, profileKey, remote, project string, existingProfiles set.StringSet, verify, overwrite bool) error {
+	proPath, err := ctx.stagingPath(path.Base(profileKey))
+	if err != nil {
+		return err
+	}
+
+	exists := existingProfiles.Contains(profile)
+	if exists && !overwrite {
 		defer os.Remove(proPath)
 		return warnMsgErr{msg: warningMessage{
 			msg: `%s Skipping profile ` + profile + ` as it already exists for: %s`,
 		}}
 	}
 
-	cmd := exec.Command("lxc", "profile", "create", profile)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error creating profile %s: %v", profile, err)
+	expected, err := validateProfile(profile, proPath)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		cmd := lxcCommand(projectArgs(project, "profile", "create", remote+profile)...)
+		if err := runLXC(cmd); err != nil {
+			return fmt.Errorf("Error creating profile %s: %v", profile, err)
+		}
 	}
 
 	profileFile, err := os.Open(proPath)
 	if err != nil {
 		return fmt.Errorf("Error opening backup file %s: %v", proPath, err)
 	}
+	defer profileFile.Close()
 
-	cmd = exec.Command("lxc", "profile", "edit", profile)
+	cmd := lxcCommand(projectArgs(project, "profile", "edit", remote+profile)...)
 	cmd.Stdin = profileFile
-	if err := cmd.Run(); err != nil {
+	if err := runLXC(cmd); err != nil {
 		return fmt.Errorf("Error restoring profile %s: %v", profile, err)
 	}
 
 	defer os.Remove(proPath)
+	if verify {
+		return verifyProfile(remote+profile, project, expected)
+	}
 	return nil
 }
 
-func restoreInstance(ctx *lxminContext, bkp backup) (*bytes.Buffer, error) {
+// storageVolume - a custom storage volume attached to an instance as a
+// disk device, which 'lxc export' does not capture.
+type storageVolume struct {
+	Device string // disk device of the instance the volume is attached as
+	Pool   string
+	Name   string
+}
+
+// parseVolumes - returns the custom storage volumes attached to the
+// instance from its expanded config, ordered by device name. The root
+// disk and host paths passed through as disks are not volumes.
+func parseVolumes(config []byte) ([]storageVolume, error) {
+	var instanceConfig struct {
+		Devices map[string]map[string]string `yaml:"devices"`
+	}
+	if err := yaml.Unmarshal(config, &instanceConfig); err != nil {
+		return nil, fmt.Errorf("Unable to parse instance config: %v", err)
+	}
+
+	var volumes []storageVolume
+	for device, dev := range instanceConfig.Devices {
+		if dev["type"] != "disk" || dev["pool"] == "" || dev["source"] == "" || dev["path"] == "/" {
+			continue
+		}
+		volumes = append(volumes, storageVolume{Device: device, Pool: dev["pool"], Name: dev["source"]})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Device < volumes[j].Device })
+	return volumes, nil
+}
+
+// listVolumes - lists the custom storage volumes attached to the
+// instance, including those attached through its profiles.
+func listVolumes(instance string) ([]storageVolume, error) {
+	var outBuf, errBuf bytes.Buffer
+	cmd := lxcCommand("config", "show", "--expanded", instance)
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	if err := runLXC(cmd); err != nil {
+		return nil, fmt.Errorf("Unable get instance config: %w", withStderr(err, &errBuf))
+	}
+	return parseVolumes(outBuf.Bytes())
+}
+
+// exportVolume - exports the custom storage volume, on the remote of the
+// instance, to dstFile.
+func exportVolume(remote string, vol storageVolume, dstFile string) (int64, error) {
+	var errBuf bytes.Buffer
+	cmd := lxcCommand("storage", "volume", "export", remote+vol.Pool, vol.Name, dstFile)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = &errBuf
+
+	if err := runLXC(cmd); err != nil {
+		if errors.Is(err, errLXCTimeout) {
+			// Do not leave a partial volume backup behind.
+			os.Remove(dstFile)
+		}
+		return -1, fmt.Errorf("Unable to export storage volume %s/%s: %w", vol.Pool, vol.Name, withStderr(err, &errBuf))
+	}
+
+	s, err := os.Stat(dstFile)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to stat file %s: %v", dstFile, err)
+	}
+	return s.Size(), nil
+}
+
+// volumeExists - reports whether the custom storage volume exists in the
+// project, on the given remote.
+func volumeExists(remote, project string, vol storageVolume) bool {
+	return runLXC(lxcCommand(projectArgs(project, "storage", "volume", "show", remote+vol.Pool, "custom/"+vol.Name)...)) == nil
+}
+
+// restoreVolume - imports the staged custom storage volume, a volume that
+// already exists is skipped like an existing profile.
+func restoreVolume(ctx *lxminContext, vol storageVolume, volumeKey, remote, project string) error {
+	volPath, err := ctx.stagingPath(path.Base(volumeKey))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(volPath)
+
+	if volumeExists(remote, project, vol) {
+		return warnMsgErr{msg: warningMessage{
+			msg: `%s Skipping storage volume ` + vol.Pool + `/` + vol.Name + ` as it already exists for: %s`,
+		}}
+	}
+
+	var errBuf bytes.Buffer
+	cmd := lxcCommand(projectArgs(project, "storage", "volume", "import", remote+vol.Pool, volPath, vol.Name)...)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = &errBuf
+	if err := runLXC(cmd); err != nil {
+		return fmt.Errorf("Error importing storage volume %s/%s: %w", vol.Pool, vol.Name, withStderr(err, &errBuf))
+	}
+	return nil
+}
+
+// importRetryDelay - delay between `lxc import` attempts.
+var importRetryDelay = 2 * time.Second
+
+// transientImportErrs - lxc errors from a busy or restarting daemon,
+// these are retried unlike a genuine failure of the import.
+var transientImportErrs = []string{
+	"connection refused",
+	"connection reset by peer",
+	"resource temporarily unavailable",
+	"database is locked",
+	"i/o timeout",
+	"context deadline exceeded",
+	"service unavailable",
+	"unexpected eof",
+	"doesn't appear to be started",
+}
+
+// isTransientImportErr - reports if the `lxc import` stderr is worth a
+// retry, a name conflict is never retried.
+func isTransientImportErr(stderr string) bool {
+	msg := strings.ToLower(stderr)
+	if strings.Contains(msg, "already exists") {
+		return false
+	}
+	for _, s := range transientImportErrs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxExportEntries - tar entries of an instance tarball inspected by
+// inspectExport, the entries describing the export come first.
+const maxExportEntries = 64
+
+// exportInfo - what the first entries of an instance tarball tell about
+// the export, from its `backup/index.yaml` and the layout of the instance.
+type exportInfo struct {
+	optimized *bool  // nil if unknown
+	pool      string // storage pool of the instance, empty if unknown
+}
+
+// readExportInfo - inspects the first entries of an instance tarball to
+// tell an `--optimized-storage` export, with the instance stored as a
+// binary blob, from a regular one, and to find the storage pool of the
+// instance. Nothing is known of a tarball compressed with something else
+// than gzip.
+func readExportInfo(r io.Reader, uncompressed bool) (ei exportInfo) {
+	if !uncompressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return ei
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	optimized := func(v bool) *bool { return &v }
+	tr := tar.NewReader(r)
+	for i := 0; i < maxExportEntries; i++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			return ei
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		switch {
+		case name == "backup/index.yaml":
+			var index struct {
+				Optimized *bool  `yaml:"optimized"`
+				Pool      string `yaml:"pool"`
+			}
+			data, err := io.ReadAll(tr)
+			if err == nil && yaml.Unmarshal(data, &index) == nil {
+				ei.pool = index.Pool
+				if index.Optimized != nil {
+					ei.optimized = index.Optimized
+				}
+			}
+		case name == "backup/container.bin", name == "backup/virtual-machine.bin":
+			if ei.optimized == nil {
+				ei.optimized = optimized(true)
+			}
+		case strings.HasPrefix(name, "backup/container/"), strings.HasPrefix(name, "backup/virtual-machine/"):
+			if ei.optimized == nil {
+				ei.optimized = optimized(false)
+			}
+		}
+		// The index comes first, the instance follows it.
+		if ei.optimized != nil && (ei.pool != "" || name != "backup/index.yaml") {
+			return ei
+		}
+	}
+	return ei
+}
+
+// inspectExport - reads the first entries of the instance tarball of a
+// backup, without downloading all of it.
+func inspectExport(ctx *lxminContext, bkp backup) (exportInfo, error) {
+	obj, _, err := ctx.Store.Get(context.Background(), bkp.key())
+	if err != nil {
+		return exportInfo{}, fmt.Errorf("Unable to inspect instance backup %s: %v", bkp.key(), err)
+	}
+	defer obj.Close()
+	return readExportInfo(obj, bkp.uncompressed), nil
+}
+
+// checkOptimized - cross-checks the optimized metadata of a backup with
+// its instance tarball, a mismatch fails `lxc import` later on.
+func (ei exportInfo) checkOptimized(bkp backup, optimized bool) error {
+	if ei.optimized == nil || *ei.optimized == optimized {
+		return nil
+	}
+	kind := "a regular"
+	if *ei.optimized {
+		kind = "an optimized storage"
+	}
+	return fmt.Errorf("Backup %s is marked optimized=%t but its instance tarball looks like %s export, 'lxc import' may fail", bkp.backupName, optimized, kind)
+}
+
+// checkPool - warns when the instance is restored into another storage
+// pool than the one it was backed up from.
+func (ei exportInfo) checkPool(bkp backup, pool string) error {
+	if pool == "" || ei.pool == "" || ei.pool == pool {
+		return nil
+	}
+	return fmt.Errorf("Backup %s was made from storage pool '%s', restoring it into '%s'", bkp.backupName, ei.pool, pool)
+}
+
+// storagePoolExists - reports whether the storage pool exists, pool may
+// have a `remote:` prefix.
+func storagePoolExists(pool string) bool {
+	return runLXC(lxcCommand("storage", "show", pool)) == nil
+}
+
+// importOpts - where and how 'lxc import' restores an instance.
+type importOpts struct {
+	target  string // name of the restored instance, empty for the name in the backup
+	project string // LXD project, empty for the default project
+	pool    string // storage pool, empty for the pool recorded in the backup
+	start   bool   // start the instance once imported
+}
+
+// importArgs - lxc arguments importing src on the remote of the backed up
+// instance, returns them with the `remote:instance` name of the imported
+// instance.
+func importArgs(bkp backup, src string, iopts importOpts) ([]string, string) {
+	remote, name := splitRemote(bkp.instance)
+	args := []string{"import"}
+	if remote != "" {
+		args = append(args, remote)
+	}
+	args = append(args, src)
+	if iopts.target != "" {
+		args = append(args, iopts.target)
+		name = iopts.target
+	}
+	if iopts.pool != "" {
+		args = append(args, "--storage", iopts.pool)
+	}
+	return append([]string{lxcBinary}, projectArgs(iopts.project, args...)...), remote + name
+}
+
+// restoreInstance - imports the staged instance backup as set by iopts.
+func restoreInstance(ctx *lxminContext, bkp backup, iopts importOpts) (*bytes.Buffer, error) {
 	outBuf := bytes.Buffer{}
-	localPath := path.Join(ctx.StagingRoot, bkp.backupName+"_instance.tar.gz")
+	localPath, err := ctx.stagingPath(path.Base(bkp.key()))
+	if err != nil {
+		return nil, err
+	}
 
-	lastCmd := []string{"lxc", "import", localPath}
+	lastCmd, imported := importArgs(bkp, localPath, iopts)
+	for attempt := 0; ; attempt++ {
+		outBuf.Reset()
+		cmd := exec.Command(lastCmd[0], lastCmd[1:]...)
+		cmd.Stdout = ioutil.Discard
+		cmd.Stderr = &outBuf
+		err = runLXC(cmd)
+		if err == nil || attempt >= ctx.ImportRetries || !isTransientImportErr(outBuf.String()) {
+			break
+		}
+		time.Sleep(importRetryDelay)
+	}
+	if err != nil {
+		errBuf := bytes.Buffer{}
+		errBuf.Write([]byte(
+			fmt.Sprintf("Command: %s\n", strings.Join(lastCmd, " ")),
+		))
+		errBuf.Write(outBuf.Bytes())
+		return &errBuf, fmt.Errorf("Error importing instance: %v", err)
+	}
+
+	defer os.Remove(localPath)
+	if !iopts.start {
+		return nil, nil
+	}
+	return startInstance(imported, iopts.project)
+}
+
+// streamInstance - restores an instance by piping the instance tarball
+// from MinIO into 'lxc import -', without staging it. The stream can not
+// be replayed, so unlike restoreInstance the import is not retried. bar
+// is optional.
+func streamInstance(ctx *lxminContext, bkp backup, iopts importOpts, bar *pb.ProgressBar) (*bytes.Buffer, error) {
+	obj, _, err := ctx.Store.Get(context.Background(), bkp.key())
+	if err != nil {
+		return nil, fmt.Errorf("Error downloading instance backup %s: %v", bkp.key(), err)
+	}
+	defer obj.Close()
+
+	var r io.Reader = obj
+	if bar != nil {
+		r = bar.NewProxyReader(obj)
+	}
+
+	outBuf := bytes.Buffer{}
+	lastCmd, imported := importArgs(bkp, "-", iopts)
 	cmd := exec.Command(lastCmd[0], lastCmd[1:]...)
+	cmd.Stdin = r
 	cmd.Stdout = ioutil.Discard
 	cmd.Stderr = &outBuf
-	if err := cmd.Run(); err != nil {
+	if err = runLXC(cmd); err != nil {
 		errBuf := bytes.Buffer{}
 		errBuf.Write([]byte(
 			fmt.Sprintf("Command: %s\n", strings.Join(lastCmd, " ")),
@@ -354,13 +1018,21 @@ func restoreInstance(ctx *lxminContext, bkp backup) (*bytes.Buffer, error) {
 		return &errBuf, fmt.Errorf("Error importing instance: %v", err)
 	}
 
-	// Clear outBuf for next command
-	outBuf = bytes.Buffer{}
-	lastCmd = []string{"lxc", "start", bkp.instance}
-	cmd = exec.Command(lastCmd[0], lastCmd[1:]...)
+	if !iopts.start {
+		return nil, nil
+	}
+	return startInstance(imported, iopts.project)
+}
+
+// startInstance - starts an instance in the given project, on failure
+// returns the command and its output.
+func startInstance(instance, project string) (*bytes.Buffer, error) {
+	outBuf := bytes.Buffer{}
+	lastCmd := append([]string{lxcBinary}, projectArgs(project, "start", instance)...)
+	cmd := exec.Command(lastCmd[0], lastCmd[1:]...)
 	cmd.Stdout = ioutil.Discard
 	cmd.Stderr = &outBuf
-	if err := cmd.Run(); err != nil {
+	if err := runLXC(cmd); err != nil {
 		errBuf := bytes.Buffer{}
 		errBuf.Write([]byte(
 			fmt.Sprintf("Command: %s\n", strings.Join(lastCmd, " ")),
@@ -368,7 +1040,5 @@ func restoreInstance(ctx *lxminContext, bkp backup) (*bytes.Buffer, error) {
 		errBuf.Write(outBuf.Bytes())
 		return &errBuf, fmt.Errorf("Error starting instance: %v", err)
 	}
-
-	defer os.Remove(localPath)
 	return nil, nil
 }
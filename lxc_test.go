@@ -0,0 +1,461 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/cli"
+	"github.com/minio/minio-go/v7/pkg/set"
+)
+
+// fakeLXC - replaces the lxc client with a shell script for the duration
+// of the test, returns the path of the script.
+func fakeLXC(t *testing.T, script string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "lxc")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := lxcBinary
+	lxcBinary = bin
+	t.Cleanup(func() { lxcBinary = prev })
+	return bin
+}
+
+func TestApplyExportArgs(t *testing.T) {
+	testCases := []struct {
+		args    string
+		bopts   backupOpts
+		want    backupOpts
+		wantErr bool
+	}{
+		{args: "", want: backupOpts{}},
+		{args: "--instance-only", want: backupOpts{InstanceOnly: true}},
+		{args: "--optimized-storage", want: backupOpts{Optimized: true}},
+		{args: "--compression=gzip", want: backupOpts{}},
+		{args: "--compression=none", want: backupOpts{Uncompressed: true}},
+		{args: "--optimized-storage --compression=none", want: backupOpts{Optimized: true, Uncompressed: true}},
+		{args: "--compression=none", bopts: backupOpts{CompressLevel: 9}, wantErr: true},
+		{args: "--compression=xz", wantErr: true},
+		{args: "--compression=zstd", wantErr: true},
+		{args: "--compression", wantErr: true},
+		{args: "--target=remote", wantErr: true},
+	}
+	for _, tc := range testCases {
+		bopts := tc.bopts
+		err := bopts.applyExportArgs(strings.Fields(tc.args))
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%q: expected error %t, got %v", tc.args, tc.wantErr, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(bopts, tc.want) {
+			t.Errorf("%q: expected %+v, got %+v", tc.args, tc.want, bopts)
+		}
+	}
+}
+
+func TestExportInstanceArgs(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	// Records the arguments and writes the tarball, the last argument.
+	fakeLXC(t, `echo "$@" > `+argsFile+`
+for last; do :; done
+echo tarball > "$last"
+`)
+
+	testCases := []struct {
+		exportArgs string
+		want       string
+	}{
+		{"", "export u1"},
+		{"--optimized-storage", "export --optimized-storage u1"},
+		{"--compression=none", "export --compression none u1"},
+		{"--instance-only --compression=gzip", "export --instance-only u1"},
+	}
+	for _, tc := range testCases {
+		var bopts backupOpts
+		if err := bopts.applyExportArgs(strings.Fields(tc.exportArgs)); err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(t.TempDir(), "u1.tar.gz")
+		if _, err := exportInstance("u1", dst, bopts); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tc.want + " " + dst + "\n"; string(got) != want {
+			t.Errorf("%q: expected %q, got %q", tc.exportArgs, want, got)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	testCases := []struct {
+		compression   string
+		compressLevel int
+		exportArgs    []string
+		uncompressed  bool
+		wantErr       bool
+	}{
+		{compression: ""},
+		{compression: "gzip"},
+		{compression: "gzip", compressLevel: 9},
+		{compression: "none", uncompressed: true},
+		{compression: "none", exportArgs: []string{"--optimized-storage"}, uncompressed: true},
+		{compression: "none", compressLevel: 9, wantErr: true},
+		{compression: "none", exportArgs: []string{"--compression=gzip"}, wantErr: true},
+		{compression: "xz", wantErr: true},
+	}
+	for _, tc := range testCases {
+		uncompressed, err := parseCompression(tc.compression, tc.compressLevel, tc.exportArgs)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%q %d %q: expected error %t, got %v", tc.compression, tc.compressLevel, tc.exportArgs, tc.wantErr, err)
+			continue
+		}
+		if uncompressed != tc.uncompressed {
+			t.Errorf("%q %d %q: expected uncompressed %t, got %t", tc.compression, tc.compressLevel, tc.exportArgs, tc.uncompressed, uncompressed)
+		}
+	}
+}
+
+func TestReadExportInfoUncompressed(t *testing.T) {
+	var plain bytes.Buffer
+	tw := tar.NewWriter(&plain)
+	if err := tw.WriteHeader(&tar.Header{Name: "backup/container.bin", Mode: 0o644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(plain.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ei := readExportInfo(bytes.NewReader(plain.Bytes()), true); ei.optimized == nil || !*ei.optimized {
+		t.Errorf("expected an optimized uncompressed export, got %+v", ei)
+	}
+	if ei := readExportInfo(bytes.NewReader(compressed.Bytes()), false); ei.optimized == nil || !*ei.optimized {
+		t.Errorf("expected an optimized gzip export, got %+v", ei)
+	}
+	// A tarball that is not gzip compressed tells nothing as gzip.
+	if ei := readExportInfo(bytes.NewReader(plain.Bytes()), false); ei.optimized != nil {
+		t.Errorf("expected an unknown export, got %+v", ei)
+	}
+}
+
+func TestIncusMode(t *testing.T) {
+	prevBinary, prevTimeout := lxcBinary, lxcTimeout
+	t.Cleanup(func() { lxcBinary, lxcTimeout = prevBinary, prevTimeout })
+
+	// Only the incus client is installed.
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\nfor last; do :; done\necho tarball > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "incus"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("HOME", t.TempDir())
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Bool("incus", false, "")
+	set.Duration("lxc-timeout", 0, "")
+	if err := set.Parse([]string{"--incus", "--lxc-timeout=1m"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setLXCOptions(cli.NewContext(nil, set, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if lxcBinary != "incus" {
+		t.Fatalf("expected incus binary, got %q", lxcBinary)
+	}
+	if lxcTimeout != time.Minute {
+		t.Fatalf("expected 1m timeout, got %v", lxcTimeout)
+	}
+
+	exitCode := -1
+	prevExiter, prevErrWriter := cli.OsExiter, cli.ErrWriter
+	cli.OsExiter = func(code int) { exitCode = code }
+	cli.ErrWriter = io.Discard
+	t.Cleanup(func() { cli.OsExiter, cli.ErrWriter = prevExiter, prevErrWriter })
+
+	// `--incus` is accepted before and after the command name.
+	for _, args := range [][]string{
+		{"lxmin", "--incus", "backup", "u2"},
+		{"lxmin", "backup", "--incus", "u2"},
+	} {
+		lxcBinary, exitCode = "lxc", -1
+		app := newApp()
+		app.Writer, app.ErrWriter = io.Discard, io.Discard
+		app.Run(args)
+		if lxcBinary != "incus" {
+			t.Errorf("%q: expected incus binary, got %q", args, lxcBinary)
+		}
+		if exitCode == exitCodeLXCNotFound {
+			t.Errorf("%q: unexpected exit code %d", args, exitCode)
+		}
+	}
+
+	// Without `--incus` the missing lxc client is reported.
+	lxcBinary, exitCode = "lxc", -1
+	app := newApp()
+	app.Writer, app.ErrWriter = io.Discard, io.Discard
+	app.Run([]string{"lxmin", "backup", "u2"})
+	if exitCode != exitCodeLXCNotFound {
+		t.Errorf("expected exit code %d, got %d", exitCodeLXCNotFound, exitCode)
+	}
+
+	// The incus client receives the same arguments as lxc.
+	lxcBinary = "incus"
+	dst := filepath.Join(t.TempDir(), "u1.tar.gz")
+	if _, err := exportInstance("u1", dst, backupOpts{Optimized: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "export --optimized-storage u1 " + dst + "\n"; string(got) != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestIsTransientImportErr(t *testing.T) {
+	testCases := []struct {
+		stderr    string
+		transient bool
+	}{
+		{"Error: Get \"http://unix.socket/1.0\": dial unix /var/snap/lxd/common/lxd/unix.socket: connect: connection refused", true},
+		{"Error: read unix @->/var/lib/lxd/unix.socket: read: connection reset by peer", true},
+		{"Error: Failed to create instance: database is locked", true},
+		{"Error: LXD unix socket \"/var/snap/lxd/common/lxd/unix.socket\" not accessible: context deadline exceeded", true},
+		{"Error: Service Unavailable", true},
+		{"Error: unexpected EOF", true},
+		{"Error: LXD unix socket doesn't appear to be started", true},
+		{"Error: Create instance from backup: Instance \"u1\" already exists", false},
+		// A name conflict is never retried, even along a transient error.
+		{"Error: connection refused, instance already exists", false},
+		{"Error: Failed importing backup: Unsupported compression", false},
+		{"Error: Storage pool not found", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if got := isTransientImportErr(tc.stderr); got != tc.transient {
+			t.Errorf("%q: expected transient %t, got %t", tc.stderr, tc.transient, got)
+		}
+	}
+}
+
+func TestRestoreInstanceRetries(t *testing.T) {
+	prevDelay := importRetryDelay
+	importRetryDelay = 0
+	t.Cleanup(func() { importRetryDelay = prevDelay })
+	newTestContext(t)
+
+	testCases := []struct {
+		name         string
+		stderr       string
+		failures     int // attempts failing before the import succeeds
+		retries      int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"transient", "Error: connection refused", 2, 3, 3, false},
+		{"retries exhausted", "Error: connection refused", 10, 2, 3, true},
+		{"no retries", "Error: database is locked", 10, 0, 1, true},
+		{"name conflict", "Error: Instance \"u1\" already exists", 10, 3, 1, true},
+		{"permanent", "Error: Storage pool not found", 10, 3, 1, true},
+	}
+	for _, tc := range testCases {
+		counter := filepath.Join(t.TempDir(), "attempts")
+		fakeLXC(t, `echo x >> `+counter+`
+if [ "$(wc -l < `+counter+`)" -le `+strconv.Itoa(tc.failures)+` ]; then
+	echo '`+tc.stderr+`' >&2
+	exit 1
+fi
+`)
+		globalContext.ImportRetries = tc.retries
+		outBuf, err := restoreInstance(globalContext, backup{instance: "u1", backupName: "b1"}, importOpts{})
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %t, got %v", tc.name, tc.wantErr, err)
+		}
+		if err != nil && !strings.Contains(outBuf.String(), tc.stderr) {
+			t.Errorf("%s: expected the lxc stderr in the output, got %q", tc.name, outBuf)
+		}
+		data, _ := os.ReadFile(counter)
+		if attempts := strings.Count(string(data), "x"); attempts != tc.wantAttempts {
+			t.Errorf("%s: expected %d attempts, got %d", tc.name, tc.wantAttempts, attempts)
+		}
+	}
+}
+
+func TestSplitRemote(t *testing.T) {
+	testCases := []struct {
+		instance     string
+		remote, name string
+	}{
+		{"u1", "", "u1"},
+		{"lxd2:u1", "lxd2:", "u1"},
+		{":u1", "", "u1"},
+		{"lxd2:", "lxd2:", ""},
+		{"", "", ""},
+	}
+	for _, tc := range testCases {
+		remote, name := splitRemote(tc.instance)
+		if remote != tc.remote || name != tc.name {
+			t.Errorf("%q: expected (%q, %q), got (%q, %q)", tc.instance, tc.remote, tc.name, remote, name)
+		}
+	}
+}
+
+func TestProjectArgs(t *testing.T) {
+	testCases := []struct {
+		project string
+		args    []string
+		want    []string
+	}{
+		{"", []string{"list", "u1"}, []string{"list", "u1"}},
+		{"staging", []string{"list", "u1"}, []string{"--project", "staging", "list", "u1"}},
+		{"staging", nil, []string{"--project", "staging"}},
+	}
+	for _, tc := range testCases {
+		if got := projectArgs(tc.project, tc.args...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q %v: expected %v, got %v", tc.project, tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestImportArgs(t *testing.T) {
+	prev := lxcBinary
+	lxcBinary = "lxc"
+	t.Cleanup(func() { lxcBinary = prev })
+
+	testCases := []struct {
+		instance     string
+		iopts        importOpts
+		want         string
+		wantImported string
+	}{
+		{"u1", importOpts{}, "lxc import /staging/b1", "u1"},
+		{"lxd2:u1", importOpts{}, "lxc import lxd2: /staging/b1", "lxd2:u1"},
+		{":u1", importOpts{}, "lxc import /staging/b1", "u1"},
+		{"lxd2:u1", importOpts{target: "u2", project: "staging", pool: "fast"}, "lxc --project staging import lxd2: /staging/b1 u2 --storage fast", "lxd2:u2"},
+	}
+	for _, tc := range testCases {
+		args, imported := importArgs(backup{instance: tc.instance, backupName: "b1"}, "/staging/b1", tc.iopts)
+		if got := strings.Join(args, " "); got != tc.want || imported != tc.wantImported {
+			t.Errorf("%q %+v: expected %q importing %q, got %q importing %q", tc.instance, tc.iopts, tc.want, tc.wantImported, got, imported)
+		}
+	}
+}
+
+func TestLXCStderr(t *testing.T) {
+	fakeLXC(t, "echo 'Error: Profile not found' >&2\nexit 1\n")
+
+	_, err := exportProfile("web", filepath.Join(t.TempDir(), "web.yaml"))
+	if err == nil || !strings.HasSuffix(err.Error(), "exit status 1: Error: Profile not found") {
+		t.Fatalf("expected the lxc stderr in the error, got %v", err)
+	}
+	if err := checkInstance("u1", ""); err == nil || !strings.Contains(err.Error(), "Error: Profile not found") {
+		t.Fatalf("expected the lxc stderr in the error, got %v", err)
+	}
+
+	// Without stderr the error is left as is.
+	var stderr bytes.Buffer
+	stderr.WriteString(" \n")
+	if err := withStderr(errors.New("exit status 1"), &stderr); err.Error() != "exit status 1" {
+		t.Fatalf("expected the error alone, got %v", err)
+	}
+}
+
+func TestRestoreProfileOverwrite(t *testing.T) {
+	newTestContext(t)
+	dir := t.TempDir()
+	logFile, edited := filepath.Join(dir, "log"), filepath.Join(dir, "edited")
+	// Records the commands and the profile passed to 'lxc profile edit'.
+	fakeLXC(t, `echo "$@" >> `+logFile+`
+if [ "$2" = edit ]; then cat > `+edited+`; fi
+if [ "$2" = show ]; then cat `+edited+`; fi
+`)
+
+	const key = "u1/b1_profile_000_web.yaml"
+	testCases := []struct {
+		exists, overwrite bool
+		want              []string
+		warn              bool
+	}{
+		{exists: false, overwrite: false, want: []string{"profile create web", "profile edit web", "profile show web"}},
+		{exists: false, overwrite: true, want: []string{"profile create web", "profile edit web", "profile show web"}},
+		{exists: true, overwrite: false, warn: true},
+		{exists: true, overwrite: true, want: []string{"profile edit web", "profile show web"}},
+	}
+	for _, tc := range testCases {
+		os.Remove(logFile)
+		os.Remove(edited)
+		proPath, err := globalContext.stagingPath(path.Base(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(proPath, []byte("name: web\nconfig:\n  limits.cpu: \"2\"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		existing := set.NewStringSet()
+		if tc.exists {
+			existing.Add("web")
+		}
+
+		err = restoreProfile(globalContext, "web", key, "", "", existing, true, tc.overwrite)
+		if _, ok := err.(warnMsgErr); ok != tc.warn {
+			t.Errorf("exists=%t overwrite=%t: expected warning %t, got %v", tc.exists, tc.overwrite, tc.warn, err)
+		} else if !tc.warn && err != nil {
+			t.Errorf("exists=%t overwrite=%t: unexpected error %v", tc.exists, tc.overwrite, err)
+		}
+
+		var want string
+		for _, cmd := range tc.want {
+			want += cmd + "\n"
+		}
+		if got, _ := os.ReadFile(logFile); string(got) != want {
+			t.Errorf("exists=%t overwrite=%t: expected commands %q, got %q", tc.exists, tc.overwrite, want, got)
+		}
+		// The staged profile is removed either way.
+		if _, err := os.Stat(proPath); !os.IsNotExist(err) {
+			t.Errorf("exists=%t overwrite=%t: expected the staged profile to be removed, got %v", tc.exists, tc.overwrite, err)
+		}
+	}
+}
@@ -18,64 +18,307 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/set"
 	"github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/minio/pkg/v2/certs"
 )
 
+// backupSchemaVersion - version of the backup layout written by this
+// binary, stamped on every backup object. Backups without it predate
+// versioning and are treated as version 1.
+const backupSchemaVersion = 1
+
+// checkSchemaVersion - errors out on backups written by a newer lxmin whose
+// layout this binary cannot interpret.
+func checkSchemaVersion(key, version string) error {
+	if version == "" {
+		return nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Errorf("Invalid schema version '%s' on %s: %v", version, key, err)
+	}
+	if v > backupSchemaVersion {
+		return fmt.Errorf("%s has schema version %d, this lxmin supports up to %d - please upgrade lxmin", key, v, backupSchemaVersion)
+	}
+	return nil
+}
+
+// checkStrict - with --strict rejects objects without the schema version
+// and kind metadata of the current layout, e.g. backups that predate it
+// or objects uploaded by hand, instead of recognizing them by name.
+func (l *lxminContext) checkStrict(key, version, kind string) error {
+	if !l.Strict || (version != "" && kind != "") {
+		return nil
+	}
+	return fmt.Errorf("%s has no lxmin schema version or kind metadata, refusing it with --strict", key)
+}
+
+// Metadata keys of the backup objects. lxmin's own keys share a prefix
+// so that they do not collide with metadata set by users or other tools.
+const (
+	metaPrefix        = "lxmin-"
+	metaSchemaVersion = metaPrefix + "schema-version"
+	metaKind          = metaPrefix + "kind"
+	metaOptimized     = metaPrefix + "optimized"
+	metaCompressed    = metaPrefix + "compressed"
+	metaSnapshots     = metaPrefix + "snapshots"
+	metaCompressLevel = metaPrefix + "compress-level"
+	metaSHA256        = metaPrefix + "sha256"
+)
+
+// legacyMetaKeys - keys the instance metadata was saved under before it
+// was prefixed, still read for older backups.
+var legacyMetaKeys = map[string]string{
+	metaOptimized:     "optimized",
+	metaCompressed:    "compressed",
+	metaSnapshots:     "snapshots",
+	metaCompressLevel: "compress-level",
+	metaSHA256:        "sha256",
+}
+
+// metaValue - returns the value of an lxmin metadata key from the user
+// metadata of an object, as returned by a stat (`Lxmin-Optimized`) or a
+// listing (`X-Amz-Meta-Lxmin-Optimized`), falling back to the legacy
+// unprefixed key.
+func metaValue(m map[string]string, key string) string {
+	names := []string{key}
+	if legacy, ok := legacyMetaKeys[key]; ok {
+		names = append(names, legacy)
+	}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if v, ok := m[name]; ok {
+			return v
+		}
+		if v, ok := m["X-Amz-Meta-"+name]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Roles of the files in a backup, saved as `lxmin-kind` metadata.
+const (
+	kindInstance = "instance"
+	kindProfile  = "profile"
+	kindManifest = "manifest"
+	kindVolume   = "volume"
+	kindMarker   = "marker"
+	kindAux      = "aux"
+)
+
+// objKind - returns the role of a backup file from its `lxmin-kind`
+// metadata, falling back to the naming convention for legacy objects.
+func objKind(obj minio.ObjectInfo) string {
+	if kind := metaValue(obj.UserMetadata, metaKind); kind != "" {
+		return kind
+	}
+	if _, ok := instanceBackupName(obj.Key); ok {
+		return kindInstance
+	}
+	switch {
+	case strings.Contains(path.Base(obj.Key), "_profile_") && strings.HasSuffix(obj.Key, ".yaml"):
+		return kindProfile
+	case strings.HasSuffix(obj.Key, "_manifest.json"):
+		return kindManifest
+	case strings.HasSuffix(obj.Key, "_incomplete"):
+		return kindMarker
+	case strings.Contains(path.Base(obj.Key), "_volume_"):
+		return kindVolume
+	}
+	return kindAux
+}
+
 type backupMeta struct {
 	Size         int64
 	LastModified time.Time
 	UserMetadata minio.StringMap
+	Encryption   string // SSE-C, SSE-KMS or SSE-S3, empty if not encrypted
+	KMSKeyID     string
+	SHA256       string // empty for backups made before checksums were stored
+	StorageClass string
+	Lock         objectLock
+}
+
+// objectLock - object lock of an object, from its response headers.
+type objectLock struct {
+	Mode        string
+	RetainUntil *time.Time
+	LegalHold   bool
+}
+
+func objectLockFromHeader(h http.Header) (lock objectLock) {
+	if until, err := time.Parse(time.RFC3339, h.Get("X-Amz-Object-Lock-Retain-Until-Date")); err == nil {
+		lock.Mode = h.Get("X-Amz-Object-Lock-Mode")
+		lock.RetainUntil = &until
+	}
+	lock.LegalHold = h.Get("X-Amz-Object-Lock-Legal-Hold") == string(minio.LegalHoldEnabled)
+	return lock
+}
+
+// retained - reports whether the retention of the object has not expired.
+func (o objectLock) retained() bool {
+	return o.RetainUntil != nil && o.RetainUntil.After(time.Now())
+}
+
+// encryptionType - returns the server side encryption of the object from
+// its response headers.
+func encryptionType(h http.Header) string {
+	if h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return "SSE-C"
+	}
+	switch h.Get("X-Amz-Server-Side-Encryption") {
+	case "aws:kms":
+		return "SSE-KMS"
+	case "AES256":
+		return "SSE-S3"
+	}
+	return ""
 }
 
 type lxminContext struct {
-	Clnt           *minio.Client
+	Store          BackupStore
+	Endpoint       string
 	Bucket         string
 	StagingRoot    string
+	DerefSymlinks  bool
 	TLSCerts       *certs.Manager
 	RootCAs        *x509.CertPool
 	NotifyClnt     *http.Client
 	NotifyEndpoint string
+	NotifyRetries  int
+	NotifyTimeout  time.Duration
+	APIToken       string // REST API bearer token, TLS client certificates when empty
+
+	MaxBackupsPerInstance int
+	ImportRetries         int
+	MaxObjectSize         int64  // refuse restores larger than this, 0 for unlimited
+	StagingLowSpace       uint64 // health warns below this free staging space
+	Strict                bool   // refuse objects without lxmin metadata
 }
 
 // GetTags - fetch tags on the backup.
 func (l *lxminContext) GetTags(bkp backup) (*tags.Tags, error) {
-	opts := minio.GetObjectTaggingOptions{}
-	return l.Clnt.GetObjectTagging(context.Background(), l.Bucket, bkp.key(), opts)
+	return l.Store.Tags(context.Background(), bkp.key())
+}
+
+// statErr - explains a failed stat of a backup, in versioned buckets a
+// deleted backup has a delete marker as its latest version.
+func statErr(bkp backup, oi minio.ObjectInfo, err error) error {
+	if oi.IsDeleteMarker {
+		return fmt.Errorf("backup '%s' of instance '%s' was deleted, prior versions may still exist in the versioned bucket", bkp.backupName, bkp.instance)
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "InvalidRequest":
+		// Returned by MinIO for SSE-C objects read without a key.
+		return fmt.Errorf("backup '%s' of instance '%s' is encrypted with SSE-C, please provide its key with --encrypt-key: %v", bkp.backupName, bkp.instance, err)
+	case "AccessDenied":
+		return fmt.Errorf("access denied to backup '%s' of instance '%s', if it is encrypted check that --encrypt-key is correct: %v", bkp.backupName, bkp.instance, err)
+	}
+	return err
+}
+
+// resolveBackup - finds the instance tarball of a backup named by the
+// user, which is uncompressed for backups made with `--compression none`.
+// The backup is returned as is when neither tarball is found, so that the
+// caller reports the missing backup.
+func (l *lxminContext) resolveBackup(bkp backup) backup {
+	_, err := l.Store.Stat(context.Background(), bkp.key())
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return bkp
+	}
+	plain := bkp
+	plain.uncompressed = !bkp.uncompressed
+	if _, err := l.Store.Stat(context.Background(), plain.key()); err == nil {
+		return plain
+	}
+	return bkp
 }
 
 // GetMetadata - get backup metadata.
 func (l *lxminContext) GetMetadata(bkp backup) (backupMeta, error) {
-	sopts := minio.StatObjectOptions{}
-	obj, err := l.Clnt.StatObject(context.Background(), l.Bucket, bkp.key(), sopts)
+	obj, err := l.Store.Stat(context.Background(), bkp.key())
 	if err != nil {
-		return backupMeta{}, err
+		return backupMeta{}, statErr(bkp, obj, err)
 	}
 
 	return backupMeta{
 		Size:         obj.Size,
 		LastModified: obj.LastModified,
 		UserMetadata: obj.UserMetadata,
+		Encryption:   encryptionType(obj.Metadata),
+		KMSKeyID:     obj.Metadata.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+		SHA256:       metaValue(obj.UserMetadata, metaSHA256),
+		StorageClass: storageClass(obj),
+		Lock:         objectLockFromHeader(obj.Metadata),
 	}, nil
 }
 
+// OverwriteMetadata - rewrites the metadata of an instance backup in place
+// with the current metadata scheme, without re-uploading the backup.
+func (l *lxminContext) OverwriteMetadata(bkp backup) error {
+	oi, err := l.Store.Stat(context.Background(), bkp.key())
+	if err != nil {
+		return err
+	}
+
+	compressed := metaValue(oi.UserMetadata, metaCompressed)
+	usermetadata := map[string]string{
+		metaOptimized:         strconv.FormatBool(strings.EqualFold(metaValue(oi.UserMetadata, metaOptimized), "true")),
+		metaCompressed:        strconv.FormatBool((compressed == "" && !bkp.uncompressed) || strings.EqualFold(compressed, "true")),
+		metaSchemaVersion:     strconv.Itoa(backupSchemaVersion),
+		metaKind:              kindInstance,
+		"Content-Type":        mime.TypeByExtension(bkp.ext()),
+		"Content-Disposition": bkp.contentDisposition(),
+	}
+	for _, key := range []string{metaSHA256, metaSnapshots, metaCompressLevel} {
+		if v := metaValue(oi.UserMetadata, key); v != "" {
+			usermetadata[key] = v
+		}
+	}
+
+	return l.Store.ReplaceMetadata(context.Background(), bkp.key(), usermetadata)
+}
+
+// deleteInfo - summary of a delete, sizes are summed from the listing.
+type deleteInfo struct {
+	Backups []string `json:"backups"`
+	Objects int      `json:"objects"`
+	Freed   int64    `json:"freed"`
+}
+
 // listAndDelete - CAUTION: deletes everything at the prefix.
-func (l *lxminContext) listAndDelete(prefix string) error {
+func (l *lxminContext) listAndDelete(prefix string) (di deleteInfo, err error) {
 	opts := minio.RemoveObjectOptions{}
+	backups := set.NewStringSet()
 
-	resCh := l.Clnt.ListObjects(context.Background(), l.Bucket, minio.ListObjectsOptions{
+	resCh := l.Store.List(context.Background(), minio.ListObjectsOptions{
 		Prefix:       prefix,
 		WithVersions: true,
 	})
@@ -86,13 +329,13 @@ func (l *lxminContext) listAndDelete(prefix string) error {
 			switch minio.ToErrorResponse(obj.Err).Code {
 			case "NotImplemented":
 				// fallback for ListObjectVersions not implemented.
-				resCh = l.Clnt.ListObjects(context.Background(), l.Bucket, minio.ListObjectsOptions{
+				resCh = l.Store.List(context.Background(), minio.ListObjectsOptions{
 					Prefix: prefix,
 				})
 				isVersioned = false
 				continue
 			default:
-				return obj.Err
+				return di, obj.Err
 			}
 		}
 
@@ -101,22 +344,66 @@ func (l *lxminContext) listAndDelete(prefix string) error {
 			// delete.
 			opts.VersionID = obj.VersionID
 		}
-		if err := l.Clnt.RemoveObject(context.Background(), l.Bucket, obj.Key, opts); err != nil {
-			return err
+		if err := l.Store.Delete(context.Background(), obj.Key, opts); err != nil {
+			// Already removed by a concurrent or earlier delete.
+			switch minio.ToErrorResponse(err).Code {
+			case "NoSuchKey", "NoSuchVersion":
+				continue
+			}
+			return di, l.lockErr(obj.Key, err)
+		}
+
+		di.Objects++
+		di.Freed += obj.Size
+		if name, ok := instanceBackupName(obj.Key); ok {
+			backups.Add(name)
 		}
 	}
 
-	return nil
+	di.Backups = backups.ToSlice()
+	return di, nil
+}
+
+// lockErr - explains a delete refused because of object lock, other
+// errors are returned as is.
+func (l *lxminContext) lockErr(key string, err error) error {
+	oi, serr := l.Store.Stat(context.Background(), key)
+	if serr != nil {
+		return err
+	}
+	lock := objectLockFromHeader(oi.Metadata)
+	switch {
+	case lock.LegalHold:
+		return fmt.Errorf("Object %s is under legal hold, unable to delete it: %v", key, err)
+	case lock.retained():
+		return fmt.Errorf("Object %s is under %s retention until %s, unable to delete it: %v",
+			key, strings.ToLower(lock.Mode), lock.RetainUntil.Format(printDate), err)
+	}
+	return err
 }
 
 // DeleteBackup - deletes a particular backup of an instance in MinIO.
-func (l *lxminContext) DeleteBackup(bkp backup) error {
+func (l *lxminContext) DeleteBackup(bkp backup) (deleteInfo, error) {
 	prefix := bkp.prefix()
 	return l.listAndDelete(prefix)
 }
 
+// checkDeleteAll - rejects instance names resolving to the bucket root
+// or above, e.g. an empty name is cleaned to '.', deleting all of their
+// backups would delete the backups of every instance.
+func checkDeleteAll(instance string) error {
+	switch path.Clean(strings.TrimSpace(instance)) {
+	case ".", "/", "..":
+		return fmt.Errorf("Refusing to delete all backups of instance '%s', it resolves to the root of the bucket", instance)
+	}
+	return nil
+}
+
 // DeleteAllBackups - deletes all backups for the given instance.
-func (l *lxminContext) DeleteAllBackups(instance string) error {
+func (l *lxminContext) DeleteAllBackups(instance string) (deleteInfo, error) {
+	if err := checkDeleteAll(instance); err != nil {
+		return deleteInfo{}, err
+	}
 	prefix := path.Clean(instance) + "/"
 	return l.listAndDelete(prefix)
 }
@@ -124,7 +411,7 @@ func (l *lxminContext) DeleteAllBackups(instance string) error {
 // ListItems - lists all items at the given prefix.
 func (l *lxminContext) ListItems(prefix string) ([]minio.ObjectInfo, error) {
 	var oi []minio.ObjectInfo
-	for obj := range l.Clnt.ListObjects(context.Background(), l.Bucket, minio.ListObjectsOptions{
+	for obj := range l.Store.List(context.Background(), minio.ListObjectsOptions{
 		Prefix:       prefix,
 		Recursive:    true,
 		WithMetadata: true,
@@ -138,12 +425,34 @@ func (l *lxminContext) ListItems(prefix string) ([]minio.ObjectInfo, error) {
 	return oi, nil
 }
 
+// CountVersions - returns the number of versions of the instance backup
+// object and their total size, delete markers are not counted. Only
+// versioned buckets keep more than one version.
+func (l *lxminContext) CountVersions(bkp backup) (count int, size int64, err error) {
+	for obj := range l.Store.List(context.Background(), minio.ListObjectsOptions{
+		Prefix:       bkp.key(),
+		WithVersions: true,
+	}) {
+		if obj.Err != nil {
+			return 0, 0, obj.Err
+		}
+		// The prefix also matches longer keys.
+		if obj.Key != bkp.key() || obj.IsDeleteMarker {
+			continue
+		}
+		count++
+		size += obj.Size
+	}
+	return count, size, nil
+}
+
 func objToBackupInfo(obj minio.ObjectInfo, instance string) backupInfo {
-	backupName := strings.TrimSuffix(path.Base(obj.Key), "_instance.tar.gz")
+	backupName, _ := instanceBackupName(obj.Key)
 
-	optimized := obj.UserMetadata["X-Amz-Meta-Optimized"] == "true"
-	compressed := obj.UserMetadata["X-Amz-Meta-Compressed"] == "true"
+	optimized := metaValue(obj.UserMetadata, metaOptimized) == "true"
+	compressed := metaValue(obj.UserMetadata, metaCompressed) == "true"
 	return backupInfo{
+		Snapshots:  parseSnapshots(metaValue(obj.UserMetadata, metaSnapshots)),
 		Instance:   instance,
 		Name:       backupName,
 		Created:    &obj.LastModified,
@@ -151,11 +460,38 @@ func objToBackupInfo(obj minio.ObjectInfo, instance string) backupInfo {
 		Optimized:  &optimized,
 		Compressed: &compressed,
 		Tags:       obj.UserTags,
+		Class:      storageClass(obj),
+		Key:        obj.Key,
+	}
+}
+
+// parseSnapshots - parses the snapshots marker of a backup, nil for
+// backups made before it was recorded.
+func parseSnapshots(v string) *bool {
+	if v == "" {
+		return nil
+	}
+	snapshots := v == "true"
+	return &snapshots
+}
+
+// storageClass - storage class of the object, MinIO leaves out the
+// default class.
+func storageClass(obj minio.ObjectInfo) string {
+	if obj.StorageClass == "" {
+		return "STANDARD"
 	}
+	return obj.StorageClass
+}
+
+// backupURI - S3 URI of a backup object, e.g. for 'mc' or 'aws s3'.
+func (l *lxminContext) backupURI(key string) string {
+	return "s3://" + l.Bucket + "/" + key
 }
 
 // ListBackups - lists available backups in MinIO. If `instance` is empty lists
-// backups for all instances.
+// backups for all instances. Backups written by a newer lxmin, or without
+// lxmin metadata with --strict, are skipped with a warning.
 func (l *lxminContext) ListBackups(instance string) ([]backupInfo, error) {
 	var backups []backupInfo
 	prefix := ""
@@ -167,9 +503,29 @@ func (l *lxminContext) ListBackups(instance string) ([]backupInfo, error) {
 		return nil, err
 	}
 
+	// Backups still holding their incomplete marker were interrupted.
+	incomplete := set.NewStringSet()
+	for _, obj := range backupItems {
+		if objKind(obj) == kindMarker {
+			incomplete.Add(strings.TrimSuffix(obj.Key, "_incomplete"))
+		}
+	}
+
 	for _, obj := range backupItems {
 		// Do not consider the profiles in the listing.
-		if !strings.HasSuffix(obj.Key, "_instance.tar.gz") {
+		if objKind(obj) != kindInstance {
+			continue
+		}
+
+		// A single unreadable backup must not hide the others, e.g. from
+		// prune and retention, it is left out of the listing instead.
+		version := metaValue(obj.UserMetadata, metaSchemaVersion)
+		if err := l.checkStrict(obj.Key, version, metaValue(obj.UserMetadata, metaKind)); err != nil {
+			log.Printf("Skipping backup: %v", err)
+			continue
+		}
+		if err := checkSchemaVersion(obj.Key, version); err != nil {
+			log.Printf("Skipping backup: %v", err)
 			continue
 		}
 
@@ -178,51 +534,509 @@ func (l *lxminContext) ListBackups(instance string) ([]backupInfo, error) {
 			inst = path.Dir(obj.Key)
 		}
 
-		backups = append(backups, objToBackupInfo(obj, inst))
+		bi := objToBackupInfo(obj, inst)
+		bi.Incomplete = incomplete.Contains(path.Join(path.Dir(obj.Key), bi.Name))
+		backups = append(backups, bi)
 	}
+	sortBackups(backups, sortByCreated, false)
 	return backups, nil
 }
 
+// Orderings of backups, by creation time newest first, by name or by
+// size largest first.
+const (
+	sortByCreated = "created"
+	sortByName    = "name"
+	sortBySize    = "size"
+)
+
+// sortBackups - sorts the backups in the given order, reversed with
+// reverse. Backups that are equal in that order are sorted by name.
+func sortBackups(backups []backupInfo, by string, reverse bool) {
+	less := func(a, b backupInfo) bool {
+		switch by {
+		case sortByCreated:
+			if !a.Created.Equal(*b.Created) {
+				return a.Created.After(*b.Created)
+			}
+		case sortBySize:
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Instance < b.Instance
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if reverse {
+			return less(backups[j], backups[i])
+		}
+		return less(backups[i], backups[j])
+	})
+}
+
 type restoreInfo struct {
-	profiles    []string
-	profileKeys []string
-	totalSize   int64
+	profiles     []string
+	profileKeys  []string
+	checksums    []string // empty for backups without a manifest
+	missing      []string // profiles of the manifest missing from the backup
+	volumes      []manifestVolume
+	volumeKeys   []string
+	instanceSize int64
+	volumesSize  int64
+	totalSize    int64
+	optimized    bool
+}
+
+// streamable - reports whether the instance tarball can be piped into
+// 'lxc import' instead of being staged, optimized backups are always
+// staged.
+func (ri restoreInfo) streamable() bool {
+	return !ri.optimized
 }
 
-func (l *lxminContext) fetchRestoreInfo(bkp backup) (ri restoreInfo, err error) {
+// skipProfiles - drops profiles from the restore, returns the profiles
+// the instance expects to be present on the host.
+func (ri *restoreInfo) skipProfiles() []string {
+	profiles := ri.profiles
+	ri.profiles, ri.profileKeys, ri.checksums = nil, nil, nil
+	ri.totalSize = ri.instanceSize + ri.volumesSize
+	return profiles
+}
+
+// fetchRestoreInfo - collects the profiles and sizes of the backup. A
+// profile of the manifest missing from the backup fails, unless
+// allowMissing, then it is left out and listed in ri.missing.
+func (l *lxminContext) fetchRestoreInfo(bkp backup, allowMissing bool) (ri restoreInfo, err error) {
+	oi, err := l.Store.Stat(context.Background(), bkp.key())
+	if err != nil {
+		return ri, fmt.Errorf("Error getting instance backup file info: %v", statErr(bkp, oi, err))
+	}
+
+	version := metaValue(oi.UserMetadata, metaSchemaVersion)
+	if err := l.checkStrict(bkp.key(), version, metaValue(oi.UserMetadata, metaKind)); err != nil {
+		return ri, err
+	}
+	if err := checkSchemaVersion(bkp.key(), version); err != nil {
+		return ri, err
+	}
+
+	m, err := l.getManifest(bkp)
+	if err != nil {
+		return ri, err
+	}
+	if m == nil && l.Strict {
+		return ri, fmt.Errorf("Backup %s has no manifest, refusing to find its profiles by name with --strict", bkp.backupName)
+	}
+	if m != nil {
+		sort.Slice(m.Profiles, func(i, j int) bool {
+			return m.Profiles[i].Index < m.Profiles[j].Index
+		})
+		keys := make([]string, len(m.Profiles))
+		for i, p := range m.Profiles {
+			keys[i] = path.Join(bkp.instance, p.Object)
+		}
+
+		// Fail before downloading anything when a profile is missing.
+		stats, errs := l.statObjects(keys, defaultProfileConcurrency)
+		for i, p := range m.Profiles {
+			if err := errs[i]; err != nil {
+				if allowMissing && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+					ri.missing = append(ri.missing, p.Name)
+					continue
+				}
+				return ri, fmt.Errorf("Backup %s is incomplete, unable to stat %s: %v", bkp.backupName, keys[i], err)
+			}
+			if err := l.checkStrict(keys[i], metaValue(stats[i].UserMetadata, metaSchemaVersion), metaValue(stats[i].UserMetadata, metaKind)); err != nil {
+				return ri, err
+			}
+			ri.totalSize += stats[i].Size
+			ri.profiles = append(ri.profiles, p.Name)
+			ri.profileKeys = append(ri.profileKeys, keys[i])
+			ri.checksums = append(ri.checksums, p.SHA256)
+		}
+	} else if err := l.listRestoreProfiles(bkp, &ri); err != nil {
+		return ri, err
+	}
+	if m != nil && len(m.Volumes) > 0 {
+		keys := make([]string, len(m.Volumes))
+		for i, v := range m.Volumes {
+			keys[i] = path.Join(bkp.instance, v.Object)
+		}
+		stats, errs := l.statObjects(keys, defaultProfileConcurrency)
+		for i, v := range m.Volumes {
+			if err := errs[i]; err != nil {
+				return ri, fmt.Errorf("Backup %s is incomplete, unable to stat %s: %v", bkp.backupName, keys[i], err)
+			}
+			ri.volumesSize += stats[i].Size
+			ri.volumes = append(ri.volumes, v)
+			ri.volumeKeys = append(ri.volumeKeys, keys[i])
+		}
+		ri.totalSize += ri.volumesSize
+	}
+
+	ri.instanceSize = oi.Size
+	ri.totalSize += oi.Size
+	ri.optimized = strings.EqualFold(metaValue(oi.UserMetadata, metaOptimized), "true")
+
+	// Refuse before downloading anything, e.g. a backup of the wrong instance.
+	if l.MaxObjectSize > 0 && ri.totalSize > l.MaxObjectSize {
+		return ri, fmt.Errorf("Backup %s is %s, larger than --max-object-size %s, set --max-object-size 0 to restore it anyway",
+			bkp.backupName, humanize.IBytes(uint64(ri.totalSize)), humanize.IBytes(uint64(l.MaxObjectSize)))
+	}
+	return ri, nil
+}
+
+// listRestoreProfiles - finds the profiles of a backup made before
+// manifests by their object names.
+func (l *lxminContext) listRestoreProfiles(bkp backup, ri *restoreInfo) error {
 	items, err := l.ListItems(path.Join(bkp.instance, bkp.backupName+"_profile_"))
 	if err != nil {
-		return ri, fmt.Errorf("Error listing profiles for backup %s (instance: %s): %v", bkp.backupName, bkp.instance, err)
+		return fmt.Errorf("Error listing profiles for backup %s (instance: %s): %v", bkp.backupName, bkp.instance, err)
 	}
 
-	for pno, obj := range items {
-		expectedProfilePrefix := fmt.Sprintf("%s_profile_%03d_", bkp.backupName, pno)
-		profileName := strings.TrimPrefix(
-			strings.TrimSuffix(path.Base(obj.Key), ".yaml"),
-			expectedProfilePrefix,
-		)
+	// Order the profiles by the index in their names instead of trusting
+	// the order of the listing.
+	type indexedProfile struct {
+		index int
+		name  string
+		obj   minio.ObjectInfo
+	}
+	var found []indexedProfile
+	for _, obj := range items {
+		// Skip files that are not profiles, e.g. auxiliary files.
+		if objKind(obj) != kindProfile {
+			continue
+		}
 
-		// Validate the profile object name.
-		if !strings.HasPrefix(path.Base(obj.Key), expectedProfilePrefix) || !strings.HasSuffix(obj.Key, ".yaml") || profileName == "" {
-			return ri, fmt.Errorf("Unexpected profile file found: %s", obj.Key)
+		index, name, err := parseProfileKey(bkp.backupName, obj.Key)
+		if err != nil {
+			return err
 		}
+		found = append(found, indexedProfile{index: index, name: name, obj: obj})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].index < found[j].index })
 
-		ri.totalSize += obj.Size
-		ri.profiles = append(ri.profiles, profileName)
-		ri.profileKeys = append(ri.profileKeys, obj.Key)
+	for pno, pf := range found {
+		switch {
+		case pf.index < pno:
+			return fmt.Errorf("Duplicate profile %03d found in backup %s: %s", pf.index, bkp.backupName, pf.obj.Key)
+		case pf.index > pno:
+			return fmt.Errorf("Profile %03d is missing from backup %s, found %s instead", pno, bkp.backupName, pf.obj.Key)
+		}
+
+		ri.totalSize += pf.obj.Size
+		ri.profiles = append(ri.profiles, pf.name)
+		ri.profileKeys = append(ri.profileKeys, pf.obj.Key)
+		ri.checksums = append(ri.checksums, "")
 	}
+	return nil
+}
 
-	oi, err := l.Clnt.StatObject(context.Background(), l.Bucket, bkp.key(), minio.StatObjectOptions{})
+// parseProfileKey - parses the index and the profile name out of a
+// profile object key of the form `<backup>_profile_<index>_<name>.yaml`.
+func parseProfileKey(backupName, key string) (index int, name string, err error) {
+	rest, ok := strings.CutPrefix(path.Base(key), backupName+"_profile_")
+	if ok {
+		rest, ok = strings.CutSuffix(rest, ".yaml")
+	}
+	var num string
+	if ok {
+		num, name, ok = strings.Cut(rest, "_")
+	}
+	if ok {
+		index, err = strconv.Atoi(num)
+		ok = err == nil && index >= 0 && name != ""
+	}
+	if !ok {
+		return 0, "", fmt.Errorf("Unexpected profile file found: %s", key)
+	}
+	return index, name, nil
+}
+
+// statObjects - stats the objects with up to concurrency requests in
+// flight, returning the results and errors in the order of keys.
+func (l *lxminContext) statObjects(keys []string, concurrency int) ([]minio.ObjectInfo, []error) {
+	stats := make([]minio.ObjectInfo, len(keys))
+	errs := make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			stats[i], errs[i] = l.Store.Stat(context.Background(), keys[i])
+		}(i)
+	}
+	wg.Wait()
+	return stats, errs
+}
+
+// backupManifest - saved along with each backup, lists the profiles in
+// the order they are applied and the custom storage volumes backed up
+// with `--volumes`.
+type backupManifest struct {
+	Profiles []manifestProfile `json:"profiles"`
+	Volumes  []manifestVolume  `json:"volumes,omitempty"`
+}
+
+type manifestProfile struct {
+	Name   string `json:"name"`
+	Index  int    `json:"index"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type manifestVolume struct {
+	Device string `json:"device"`
+	Pool   string `json:"pool"`
+	Name   string `json:"name"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// volume - returns the storage volume the entry was exported from.
+func (mv manifestVolume) volume() storageVolume {
+	return storageVolume{Device: mv.Device, Pool: mv.Pool, Name: mv.Name}
+}
+
+// putManifest - uploads the manifest of the backup.
+func (l *lxminContext) putManifest(bkp backup, bopts backupOpts, m backupManifest) error {
+	buf, err := json.Marshal(m)
 	if err != nil {
-		return ri, fmt.Errorf("Error getting instance backup file info: %v", err)
+		return err
 	}
 
-	ri.totalSize += oi.Size
-	return ri, nil
+	opts := bopts.withObjectOptions(minio.PutObjectOptions{
+		UserTags:    bopts.TagsSet.ToMap(),
+		ContentType: "application/json",
+		UserMetadata: map[string]string{
+			metaSchemaVersion: strconv.Itoa(backupSchemaVersion),
+			metaKind:          kindManifest,
+		},
+	})
+	if err = l.Store.Put(context.Background(), bkp.manifestKey(), bytes.NewReader(buf), int64(len(buf)), opts); err != nil {
+		return fmt.Errorf("Error uploading manifest %s: %v", bkp.manifestKey(), err)
+	}
+	return nil
+}
+
+// putIncompleteMarker - uploads the marker of a backup in progress, it is
+// removed by removeIncompleteMarker once the manifest is uploaded. The
+// marker has no retention so that it can always be removed.
+func (l *lxminContext) putIncompleteMarker(bkp backup) error {
+	opts := minio.PutObjectOptions{
+		UserMetadata: map[string]string{
+			metaSchemaVersion: strconv.Itoa(backupSchemaVersion),
+			metaKind:          kindMarker,
+		},
+	}
+	if err := l.Store.Put(context.Background(), bkp.incompleteKey(), bytes.NewReader(nil), 0, opts); err != nil {
+		return fmt.Errorf("Error uploading marker %s: %v", bkp.incompleteKey(), err)
+	}
+	return nil
+}
+
+// removeIncompleteMarker - marks the backup as complete.
+func (l *lxminContext) removeIncompleteMarker(bkp backup) error {
+	if err := l.Store.Delete(context.Background(), bkp.incompleteKey(), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("Error removing marker %s: %v", bkp.incompleteKey(), err)
+	}
+	return nil
+}
+
+// errIncompleteBackup - the backup was interrupted before its manifest was
+// uploaded, some of its files may be missing.
+var errIncompleteBackup = errors.New("the backup was interrupted before all of its files were uploaded")
+
+// checkComplete - fails with errIncompleteBackup for a backup that still
+// has its incomplete marker.
+func (l *lxminContext) checkComplete(bkp backup) error {
+	_, err := l.Store.Stat(context.Background(), bkp.incompleteKey())
+	if err == nil {
+		return fmt.Errorf("Backup %s is incomplete: %w", bkp.backupName, errIncompleteBackup)
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil
+	}
+	return fmt.Errorf("Error checking backup %s: %v", bkp.backupName, err)
+}
+
+// getManifest - fetches the manifest of the backup, returns nil for
+// backups made before manifests were introduced.
+func (l *lxminContext) getManifest(bkp backup) (*backupManifest, error) {
+	r, _, err := l.Store.Get(context.Background(), bkp.manifestKey())
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error fetching manifest %s: %v", bkp.manifestKey(), err)
+	}
+	defer r.Close()
+
+	var m backupManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest %s: %v", bkp.manifestKey(), err)
+	}
+	return &m, nil
+}
+
+// fileSHA256 - returns the hex encoded SHA-256 checksum of the file.
+func fileSHA256(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (l *lxminContext) downloadItem(objPath string, bar *pb.ProgressBar) error {
-	fpath := path.Join(l.StagingRoot, path.Base(objPath))
+// putInstanceBackup - uploads the instance tarball of the backup along
+// with its SHA-256 checksum, computed from the staged file beforehand so
+// that the checksum is part of the single upload. Upload progress is
+// reported to progress, if set.
+func (l *lxminContext) putInstanceBackup(bkp backup, bopts backupOpts, r io.Reader, size int64, sha256 string, progress io.Reader) error {
+	opts := bopts.withObjectOptions(minio.PutObjectOptions{
+		UserTags:           bopts.TagsSet.ToMap(),
+		PartSize:           uint64(bopts.PartSize),
+		UserMetadata:       bopts.instanceMetadata(sha256),
+		ContentType:        mime.TypeByExtension(bkp.ext()),
+		ContentDisposition: bkp.contentDisposition(),
+		Progress:           progress,
+	})
+	return l.Store.Put(context.Background(), bkp.key(), r, size, opts)
+}
+
+// downloadProfiles - downloads the profiles of the backup to the staging
+// root, validating them against the checksums from the manifest.
+func (l *lxminContext) downloadProfiles(ri restoreInfo, bar *pb.ProgressBar, progress io.Writer) error {
+	for i, pkey := range ri.profileKeys {
+		if err := l.downloadItem(pkey, bar, progress, true); err != nil {
+			return fmt.Errorf("Error downloading profile file %s: %v", pkey, err)
+		}
+		if ri.checksums[i] == "" {
+			continue
+		}
+
+		fpath, err := l.stagingPath(path.Base(pkey))
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(fpath)
+		if err != nil {
+			return fmt.Errorf("Unable to checksum profile file %s: %v", fpath, err)
+		}
+		if sum != ri.checksums[i] {
+			return fmt.Errorf("Profile file %s does not match the backup manifest, expected checksum %s, got %s", pkey, ri.checksums[i], sum)
+		}
+	}
+	return nil
+}
+
+// downloadVolumes - downloads the custom storage volumes of the backup to
+// the staging root, validating them against the checksums from the
+// manifest.
+func (l *lxminContext) downloadVolumes(ri restoreInfo, bar *pb.ProgressBar, progress io.Writer) error {
+	for i, vkey := range ri.volumeKeys {
+		if err := l.downloadItem(vkey, bar, progress, false); err != nil {
+			return fmt.Errorf("Error downloading storage volume file %s: %v", vkey, err)
+		}
+
+		fpath, err := l.stagingPath(path.Base(vkey))
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(fpath)
+		if err != nil {
+			return fmt.Errorf("Unable to checksum storage volume file %s: %v", fpath, err)
+		}
+		if sum != ri.volumes[i].SHA256 {
+			return fmt.Errorf("Storage volume file %s does not match the backup manifest, expected checksum %s, got %s", vkey, ri.volumes[i].SHA256, sum)
+		}
+	}
+	return nil
+}
+
+// checkStagingRoot - verifies the staging root is a writable directory,
+// so that a misconfigured staging fails at startup instead of midway
+// through exporting an instance.
+func checkStagingRoot(root string) error {
+	st, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("Unable to access staging root %s: %v", root, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("Staging root %s is not a directory", root)
+	}
+
+	f, err := os.CreateTemp(root, ".lxmin-staging-check-")
+	if err != nil {
+		return fmt.Errorf("Staging root %s is not writable: %v", root, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// resolveStagingRoot - resolves all symlinks in the staging root so that
+// staging writes can be checked against the real directory.
+func resolveStagingRoot(root string) (string, error) {
+	if root == "" {
+		root = "."
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve staging root %s: %v", root, err)
+	}
+	return filepath.Abs(resolved)
+}
+
+// stagingPath - returns the path for name under the staging root. With
+// `--dereference-symlinks` the path is resolved and rejected if it
+// escapes the staging root or points at a symlink.
+func (l *lxminContext) stagingPath(name string) (string, error) {
+	fpath := path.Join(l.StagingRoot, name)
+	if !l.DerefSymlinks {
+		return fpath, nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(fpath))
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve staging path %s: %v", fpath, err)
+	}
+	fpath = filepath.Join(dir, filepath.Base(fpath))
+
+	rel, err := filepath.Rel(l.StagingRoot, fpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Staging path %s is outside of staging root %s", fpath, l.StagingRoot)
+	}
+
+	if fi, err := os.Lstat(fpath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("Staging path %s is a symlink", fpath)
+	}
+	return fpath, nil
+}
+
+// downloadItem - downloads the object to the staging root. When decodeGzip
+// is set, objects stored with 'Content-Encoding: gzip' are decompressed,
+// the transport never does this as it would corrupt the instance tarball.
+// The bytes read from MinIO are also written to progress, if set.
+func (l *lxminContext) downloadItem(objPath string, bar *pb.ProgressBar, progress io.Writer, decodeGzip bool) error {
+	fpath, err := l.stagingPath(path.Base(objPath))
+	if err != nil {
+		return err
+	}
 	var w io.Writer
 	if bar != nil {
 		barWriter, err := newBarUpdateWriter(fpath, bar, tmplDl)
@@ -240,22 +1054,102 @@ func (l *lxminContext) downloadItem(objPath string, bar *pb.ProgressBar) error {
 		w = f
 	}
 
-	obj, err := l.Clnt.GetObject(context.Background(), l.Bucket, objPath, minio.GetObjectOptions{})
+	obj, oi, err := l.Store.Get(context.Background(), objPath)
 	if err != nil {
 		return err
 	}
 	defer obj.Close()
 
-	_, err = io.Copy(w, obj)
+	var r io.Reader = obj
+	if progress != nil {
+		r = io.TeeReader(obj, progress)
+	}
+	if decodeGzip && strings.EqualFold(oi.Metadata.Get("Content-Encoding"), "gzip") {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("Unable to decompress %s: %v", objPath, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	_, err = io.Copy(w, r)
 	return err
 }
 
+// reservedInfixes - separators of the backup object names, instance and
+// backup names containing them cannot be parsed back from the keys.
+var reservedInfixes = []string{"/", plainInstanceSuffix, "_profile_", "_volume_", "_manifest.json", "_incomplete"}
+
+// validateNames - rejects instance and backup names that would make the
+// backup object names ambiguous, an empty name is not checked.
+func validateNames(instance, backupName string) error {
+	for _, infix := range reservedInfixes {
+		if strings.Contains(instance, infix) {
+			return fmt.Errorf("instance name '%s' cannot contain '%s'", instance, infix)
+		}
+		if strings.Contains(backupName, infix) {
+			return fmt.Errorf("backup name '%s' cannot contain '%s'", backupName, infix)
+		}
+	}
+	return nil
+}
+
+// errWildcardInstance - '*' means all instances only when listing backups,
+// same as the REST list API.
+var errWildcardInstance = errors.New("'*' is only supported when listing backups, please provide an instance name")
+
+// Suffixes of the instance tarball object, exported with gzip unless the
+// backup was made with `--compression none`.
+const (
+	instanceSuffix      = "_instance.tar.gz"
+	plainInstanceSuffix = "_instance.tar"
+)
+
+// instanceBackupName - returns the backup name of an instance tarball
+// object, ok is false for other objects.
+func instanceBackupName(key string) (name string, ok bool) {
+	base := path.Base(key)
+	for _, suffix := range []string{instanceSuffix, plainInstanceSuffix} {
+		if strings.HasSuffix(base, suffix) {
+			return strings.TrimSuffix(base, suffix), true
+		}
+	}
+	return "", false
+}
+
 type backup struct {
 	instance, backupName string
+	uncompressed         bool // instance tarball exported without compression
 }
 
 func (b *backup) key() string {
-	return path.Join(b.instance, b.backupName+"_instance.tar.gz")
+	return path.Join(b.instance, b.backupName+"_instance"+b.ext())
+}
+
+// ext - returns the file extension of the instance tarball.
+func (b *backup) ext() string {
+	if b.uncompressed {
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// manifestKey - returns the object name of the backup manifest.
+func (b *backup) manifestKey() string {
+	return path.Join(b.instance, b.backupName+"_manifest.json")
+}
+
+// incompleteKey - returns the object name of the marker present while
+// the backup is in progress.
+func (b *backup) incompleteKey() string {
+	return path.Join(b.instance, b.backupName+"_incomplete")
+}
+
+// contentDisposition - suggests a meaningful filename when the instance
+// tarball is downloaded directly, e.g. via a presigned URL.
+func (b *backup) contentDisposition() string {
+	return fmt.Sprintf("attachment; filename=\"%s_%s%s\"", path.Base(b.instance), b.backupName, b.ext())
 }
 
 // prefix - returns the prefix at which all backup files are present.
@@ -264,7 +1158,94 @@ func (b *backup) prefix() string {
 }
 
 type backupOpts struct {
-	TagsSet   *tags.Tags
-	PartSize  int64
-	Optimized bool
+	TagsSet       *tags.Tags
+	PartSize      int64
+	Optimized     bool
+	CompressLevel int    // 0 leaves the level to `lxc export`
+	Concurrency   int    // profiles exported and uploaded in parallel
+	InstanceOnly  bool   // exclude snapshots of the instance
+	GzipProfiles  bool   // upload profiles with 'Content-Encoding: gzip'
+	Volumes       bool   // also back up the custom storage volumes attached to the instance
+	Uncompressed  bool   // export the instance with '--compression none'
+	StorageClass  string // empty for the default storage class of the bucket
+
+	// Object lock of all objects of the backup, the bucket must have
+	// object lock enabled.
+	RetentionMode minio.RetentionMode
+	RetainUntil   time.Time // no retention when zero
+	LegalHold     bool
+}
+
+// newBackup - returns the backup of the instance made with these options.
+func (o backupOpts) newBackup(instance, backupName string) backup {
+	return backup{instance: instance, backupName: backupName, uncompressed: o.Uncompressed}
+}
+
+// snapshots - reports whether snapshots of the instance are exported
+// with it, they are unless excluded by --instance-only.
+func (o backupOpts) snapshots() bool {
+	return !o.InstanceOnly
+}
+
+// withObjectOptions - adds the storage class and the object lock of the
+// backup to the upload options.
+func (o backupOpts) withObjectOptions(opts minio.PutObjectOptions) minio.PutObjectOptions {
+	opts.StorageClass = o.StorageClass
+	if !o.RetainUntil.IsZero() {
+		opts.Mode = o.RetentionMode
+		opts.RetainUntilDate = o.RetainUntil
+	}
+	if o.LegalHold {
+		opts.LegalHold = minio.LegalHoldEnabled
+	}
+	if opts.Mode != "" || opts.LegalHold != "" {
+		// Object lock uploads require a Content-MD5.
+		opts.SendContentMd5 = true
+	}
+	return opts
+}
+
+// parseRetention - parses the retention of a backup, retainUntil is in
+// RFC3339 form and must be in the future. No retention without
+// retainUntil.
+func parseRetention(retainUntil, mode string) (minio.RetentionMode, time.Time, error) {
+	if retainUntil == "" {
+		return "", time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, retainUntil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid retain until date '%s', expected RFC3339 form e.g. '2030-01-02T15:04:05Z': %v", retainUntil, err)
+	}
+	if !until.After(time.Now()) {
+		return "", time.Time{}, fmt.Errorf("retain until date '%s' is not in the future", retainUntil)
+	}
+	m := minio.RetentionMode(strings.ToUpper(mode))
+	if !m.IsValid() {
+		return "", time.Time{}, fmt.Errorf("invalid retention mode '%s', expected governance or compliance", mode)
+	}
+	return m, until, nil
+}
+
+// userMetadata - returns the metadata saved along with the instance
+// tarball of a backup.
+func (o backupOpts) userMetadata() map[string]string {
+	usermetadata := map[string]string{}
+	// Save additional information if the backup is optimized or not.
+	usermetadata[metaOptimized] = strconv.FormatBool(o.Optimized)
+	usermetadata[metaCompressed] = strconv.FormatBool(!o.Uncompressed)
+	usermetadata[metaSnapshots] = strconv.FormatBool(o.snapshots())
+	if o.CompressLevel > 0 {
+		usermetadata[metaCompressLevel] = strconv.Itoa(o.CompressLevel)
+	}
+	usermetadata[metaSchemaVersion] = strconv.Itoa(backupSchemaVersion)
+	usermetadata[metaKind] = kindInstance
+	return usermetadata
+}
+
+// instanceMetadata - metadata of the instance backup, with the SHA-256
+// checksum of the tarball for `lxmin verify`.
+func (o backupOpts) instanceMetadata(sha256 string) map[string]string {
+	usermetadata := o.userMetadata()
+	usermetadata[metaSHA256] = sha256
+	return usermetadata
 }
@@ -0,0 +1,526 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestFetchRestoreInfoMaxObjectSize(t *testing.T) {
+	ms := newTestContext(t)
+	bkp := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default"}})
+
+	ri, err := globalContext.fetchRestoreInfo(bkp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		maxSize int64
+		wantErr bool
+	}{
+		{0, false},
+		{ri.totalSize + 1, false},
+		{ri.totalSize, false},
+		{ri.totalSize - 1, true},
+		{1, true},
+	}
+	for _, tc := range testCases {
+		globalContext.MaxObjectSize = tc.maxSize
+		_, err := globalContext.fetchRestoreInfo(bkp, false)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("max size %d: expected error %t, got %v", tc.maxSize, tc.wantErr, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "--max-object-size") {
+			t.Errorf("max size %d: unexpected error %v", tc.maxSize, err)
+		}
+	}
+}
+
+func TestFetchRestoreInfoMissingProfile(t *testing.T) {
+	ms := newTestContext(t)
+	bkp := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default", "web"}})
+	// e.g. removed by a lifecycle rule.
+	if err := ms.Delete(context.Background(), path.Join("u1", profileBackupName("b1", 1, "web")), minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := globalContext.fetchRestoreInfo(bkp, false); err == nil || !strings.Contains(err.Error(), "is incomplete") {
+		t.Fatalf("expected an incomplete backup error, got %v", err)
+	}
+
+	ri, err := globalContext.fetchRestoreInfo(bkp, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default"}; !reflect.DeepEqual(ri.profiles, want) {
+		t.Errorf("expected profiles %v, got %v", want, ri.profiles)
+	}
+	if want := []string{"web"}; !reflect.DeepEqual(ri.missing, want) {
+		t.Errorf("expected missing profiles %v, got %v", want, ri.missing)
+	}
+	if len(ri.profileKeys) != 1 || len(ri.checksums) != 1 {
+		t.Errorf("expected a single profile to download, got %v", ri.profileKeys)
+	}
+}
+
+// putLegacyBackup - uploads an instance tarball without lxmin metadata,
+// as made before the metadata was stamped or uploaded by hand.
+func putLegacyBackup(t *testing.T, ms *memStore, instance, name string) backup {
+	t.Helper()
+	bkp := backup{instance: instance, backupName: name}
+	if err := ms.Put(context.Background(), bkp.key(), strings.NewReader("legacy"), 6, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return bkp
+}
+
+func TestFetchRestoreInfoSchemaVersion(t *testing.T) {
+	ms := newTestContext(t)
+	current := putTestBackup(t, ms, testBackup{instance: "u1", name: "current"})
+	legacy := putLegacyBackup(t, ms, "u1", "legacy")
+
+	newer := putTestBackup(t, ms, testBackup{instance: "u1", name: "newer"})
+	oi, err := ms.Stat(context.Background(), newer.key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]string{}
+	for k, v := range oi.UserMetadata {
+		meta[k] = v
+	}
+	meta[http.CanonicalHeaderKey(metaSchemaVersion)] = strconv.Itoa(backupSchemaVersion + 1)
+	if err := ms.ReplaceMetadata(context.Background(), newer.key(), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bkp := range []backup{current, legacy} {
+		if _, err := globalContext.fetchRestoreInfo(bkp, false); err != nil {
+			t.Errorf("%s: unexpected error %v", bkp.backupName, err)
+		}
+	}
+	if _, err := globalContext.fetchRestoreInfo(newer, false); err == nil || !strings.Contains(err.Error(), "please upgrade lxmin") {
+		t.Errorf("expected a newer schema error, got %v", err)
+	}
+
+	// The newer backup is left out of the listing, the others are listed.
+	backups, err := globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backupNames(backups), []string{"u1/legacy", "u1/current"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	ms := newTestContext(t)
+	current := putTestBackup(t, ms, testBackup{instance: "u1", name: "current", profiles: []string{"default"}})
+	legacy := putLegacyBackup(t, ms, "u1", "legacy")
+
+	// Permissive mode reads legacy backups by their names.
+	if _, err := globalContext.fetchRestoreInfo(legacy, false); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	backups, err := globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backupNames(backups), []string{"u1/legacy", "u1/current"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	globalContext.Strict = true
+	if _, err := globalContext.fetchRestoreInfo(current, false); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := globalContext.fetchRestoreInfo(legacy, false); err == nil || !strings.Contains(err.Error(), "--strict") {
+		t.Errorf("expected a strict mode error, got %v", err)
+	}
+	backups, err = globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backupNames(backups), []string{"u1/current"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// A backup without a manifest is refused even with metadata.
+	if err := ms.Delete(context.Background(), current.manifestKey(), minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := globalContext.fetchRestoreInfo(current, false); err == nil || !strings.Contains(err.Error(), "no manifest") {
+		t.Errorf("expected a missing manifest error, got %v", err)
+	}
+}
+
+func TestManifestProfiles(t *testing.T) {
+	ms := newTestContext(t)
+	bkp := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default", "web", "db"}})
+
+	m, err := globalContext.getManifest(bkp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || len(m.Profiles) != 3 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	ri, err := globalContext.fetchRestoreInfo(bkp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "web", "db"}; !reflect.DeepEqual(ri.profiles, want) {
+		t.Fatalf("expected profiles %v, got %v", want, ri.profiles)
+	}
+	if err := globalContext.downloadProfiles(ri, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// A profile that does not match the manifest is rejected.
+	tampered := []byte("name: web\nconfig: {}\n")
+	if err := ms.Put(context.Background(), ri.profileKeys[1], bytes.NewReader(tampered), int64(len(tampered)), minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := globalContext.downloadProfiles(ri, nil, nil); err == nil || !strings.Contains(err.Error(), "does not match the backup manifest") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestManifestlessProfiles(t *testing.T) {
+	ms := newTestContext(t)
+	bkp := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default", "web"}})
+	if err := ms.Delete(context.Background(), bkp.manifestKey(), minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ri, err := globalContext.fetchRestoreInfo(bkp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "web"}; !reflect.DeepEqual(ri.profiles, want) {
+		t.Fatalf("expected profiles %v, got %v", want, ri.profiles)
+	}
+	if want := []string{"", ""}; !reflect.DeepEqual(ri.checksums, want) {
+		t.Fatalf("expected no checksums, got %v", ri.checksums)
+	}
+	if err := globalContext.downloadProfiles(ri, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// A gap in the numbering of the profiles is reported.
+	if err := ms.Delete(context.Background(), ri.profileKeys[0], minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := globalContext.fetchRestoreInfo(bkp, false); err == nil || !strings.Contains(err.Error(), "is missing from backup") {
+		t.Fatalf("expected a missing profile error, got %v", err)
+	}
+}
+
+func TestSortBackups(t *testing.T) {
+	at := func(hour int) *time.Time {
+		ts := time.Date(2024, 1, 1, hour, 0, 0, 0, time.UTC)
+		return &ts
+	}
+	backups := []backupInfo{
+		{Instance: "u1", Name: "b", Created: at(1), Size: 30},
+		{Instance: "u1", Name: "c", Created: at(3), Size: 10},
+		{Instance: "u2", Name: "a", Created: at(2), Size: 30},
+		{Instance: "u1", Name: "a", Created: at(2), Size: 20},
+	}
+	testCases := []struct {
+		by      string
+		reverse bool
+		want    []string
+	}{
+		// Equal creation times and sizes are sorted by name, then instance.
+		{sortByCreated, false, []string{"u1/c", "u1/a", "u2/a", "u1/b"}},
+		{sortByCreated, true, []string{"u1/b", "u2/a", "u1/a", "u1/c"}},
+		{sortByName, false, []string{"u1/a", "u2/a", "u1/b", "u1/c"}},
+		{sortByName, true, []string{"u1/c", "u1/b", "u2/a", "u1/a"}},
+		{sortBySize, false, []string{"u2/a", "u1/b", "u1/a", "u1/c"}},
+		{sortBySize, true, []string{"u1/c", "u1/a", "u1/b", "u2/a"}},
+	}
+	for _, tc := range testCases {
+		sorted := append([]backupInfo(nil), backups...)
+		sortBackups(sorted, tc.by, tc.reverse)
+		if got := backupNames(sorted); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s reverse=%v: expected %v, got %v", tc.by, tc.reverse, tc.want, got)
+		}
+	}
+}
+
+func TestListBackupsNewestFirst(t *testing.T) {
+	ms := newTestContext(t)
+	// The store clock advances with each upload.
+	for _, name := range []string{"b2", "b1", "b3"} {
+		putTestBackup(t, ms, testBackup{instance: "u1", name: name})
+	}
+	backups, err := globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backupNames(backups), []string{"u1/b3", "u1/b1", "u1/b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if err := runCommand(t, listCmd, "--sort", "bogus", "u1"); err == nil || !strings.Contains(err.Error(), "Invalid --sort") {
+		t.Errorf("expected an invalid --sort error, got %v", err)
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	testCases := []struct {
+		instance, backupName string
+		valid                bool
+	}{
+		{"u1", "backup_2022-02-16-04-1040", true},
+		{"remote:u1", "b1", true},
+		{"u1", "", true},
+		{"", "", true},
+		{"u1/u2", "b1", false},
+		{"u1", "b1/b2", false},
+		{"u1", "b1_instance.tar", false},
+		{"u1", "b1_instance.tar.gz", false},
+		{"u1_profile_x", "b1", false},
+		{"u1", "b1_profile_000_default.yaml", false},
+		{"u1", "b1_volume_000", false},
+		{"u1", "b1_manifest.json", false},
+	}
+	for _, tc := range testCases {
+		err := validateNames(tc.instance, tc.backupName)
+		if tc.valid && err != nil {
+			t.Errorf("%q %q: unexpected error %v", tc.instance, tc.backupName, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%q %q: expected an error", tc.instance, tc.backupName)
+		}
+	}
+}
+
+func TestUncompressedBackup(t *testing.T) {
+	ms := newTestContext(t)
+	plain := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default"}, bopts: backupOpts{Uncompressed: true}})
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b2"})
+	if got, want := plain.key(), "u1/b1_instance.tar"; got != want {
+		t.Fatalf("expected key %s, got %s", want, got)
+	}
+
+	backups, err := globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backupNames(backups), []string{"u1/b2", "u1/b1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if c := backups[1].Compressed; c == nil || *c {
+		t.Errorf("expected b1 to be uncompressed, got %v", c)
+	}
+
+	// Backups named by the user are found whatever their compression.
+	if bkp := globalContext.resolveBackup(backup{instance: "u1", backupName: "b1"}); !bkp.uncompressed {
+		t.Error("expected b1 to resolve to its uncompressed tarball")
+	}
+	if bkp := globalContext.resolveBackup(backup{instance: "u1", backupName: "b2"}); bkp.uncompressed {
+		t.Error("expected b2 to resolve to its gzip tarball")
+	}
+	ri, err := globalContext.fetchRestoreInfo(plain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default"}; !reflect.DeepEqual(ri.profiles, want) {
+		t.Errorf("expected profiles %v, got %v", want, ri.profiles)
+	}
+
+	di, err := globalContext.listAndDelete(plain.prefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b1"}; !reflect.DeepEqual(di.Backups, want) {
+		t.Errorf("expected deleted backups %v, got %v", want, di.Backups)
+	}
+}
+
+func TestIncompleteBackup(t *testing.T) {
+	ms := newTestContext(t)
+	complete := putTestBackup(t, ms, testBackup{instance: "u1", name: "b1", profiles: []string{"default"}})
+	interrupted := putTestBackup(t, ms, testBackup{instance: "u1", name: "b2", profiles: []string{"default"}})
+	if err := globalContext.putIncompleteMarker(interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	incomplete := func(instance string) []string {
+		t.Helper()
+		backups, err := globalContext.ListBackups(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, b := range backups {
+			if b.Incomplete {
+				names = append(names, b.Instance+"/"+b.Name)
+			}
+		}
+		return names
+	}
+	for _, instance := range []string{"u1", ""} {
+		if got, want := incomplete(instance), []string{"u1/b2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected incomplete backups %v, got %v", instance, want, got)
+		}
+	}
+
+	if err := globalContext.checkComplete(complete); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := globalContext.checkComplete(interrupted); !errors.Is(err, errIncompleteBackup) {
+		t.Errorf("expected an incomplete backup error, got %v", err)
+	}
+
+	// The marker is removed once the manifest is uploaded.
+	if err := globalContext.removeIncompleteMarker(interrupted); err != nil {
+		t.Fatal(err)
+	}
+	if err := globalContext.checkComplete(interrupted); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if got := incomplete("u1"); len(got) != 0 {
+		t.Errorf("expected no incomplete backups, got %v", got)
+	}
+
+	if err := validateNames("u1", "b3_incomplete"); err == nil {
+		t.Error("expected the marker suffix to be refused in backup names")
+	}
+}
+
+func TestMetaValue(t *testing.T) {
+	testCases := []struct {
+		meta map[string]string
+		want string
+	}{
+		{map[string]string{}, ""},
+		// Stat and listing forms of the prefixed key.
+		{map[string]string{"Lxmin-Optimized": "true"}, "true"},
+		{map[string]string{"X-Amz-Meta-Lxmin-Optimized": "true"}, "true"},
+		// Backups made before the prefix was introduced.
+		{map[string]string{"Optimized": "true"}, "true"},
+		{map[string]string{"X-Amz-Meta-Optimized": "true"}, "true"},
+		{map[string]string{"Lxmin-Optimized": "false", "Optimized": "true"}, "false"},
+		// Other tools' keys are not mistaken for lxmin ones.
+		{map[string]string{"Lxmin-Compressed": "true"}, ""},
+	}
+	for _, tc := range testCases {
+		if got := metaValue(tc.meta, metaOptimized); got != tc.want {
+			t.Errorf("%v: expected %q, got %q", tc.meta, tc.want, got)
+		}
+	}
+}
+
+func TestOverwriteLegacyMetadata(t *testing.T) {
+	ms := newTestContext(t)
+	bkp := backup{instance: "u1", backupName: "b1"}
+	legacy := map[string]string{"optimized": "true", "compressed": "true", "snapshots": "false", "sha256": "abc"}
+	if err := ms.Put(context.Background(), bkp.key(), strings.NewReader("legacy"), 6, minio.PutObjectOptions{UserMetadata: legacy}); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := globalContext.ListBackups("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Optimized == nil || !*backups[0].Optimized || backups[0].Snapshots == nil || *backups[0].Snapshots {
+		t.Fatalf("expected the legacy metadata to be read, got %+v", backups)
+	}
+
+	if err := globalContext.OverwriteMetadata(bkp); err != nil {
+		t.Fatal(err)
+	}
+	oi, err := ms.Stat(context.Background(), bkp.key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		metaOptimized:  "true",
+		metaCompressed: "true",
+		metaSnapshots:  "false",
+		metaSHA256:     "abc",
+		metaKind:       kindInstance,
+	} {
+		if got := oi.UserMetadata[http.CanonicalHeaderKey(key)]; got != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+	for key := range legacy {
+		if v, ok := oi.UserMetadata[http.CanonicalHeaderKey(key)]; ok {
+			t.Errorf("expected the legacy key %s to be dropped, got %q", key, v)
+		}
+	}
+}
+
+func TestPutInstanceBackup(t *testing.T) {
+	ms := newTestContext(t)
+	tagsSet, err := parseBackupTags("env=prod", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bopts := backupOpts{TagsSet: tagsSet, Optimized: true}
+	bkp := bopts.newBackup("u1", "b1")
+
+	data := strings.Repeat("tarball", 1000)
+	if err := globalContext.putInstanceBackup(bkp, bopts, strings.NewReader(data), int64(len(data)), sha256Hex([]byte(data)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The checksum is uploaded with the tarball, not copied onto it.
+	if ms.copies != 0 {
+		t.Errorf("expected a single upload, got %d copies", ms.copies)
+	}
+
+	meta, err := globalContext.GetMetadata(bkp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SHA256 != sha256Hex([]byte(data)) {
+		t.Errorf("expected checksum %s, got %s", sha256Hex([]byte(data)), meta.SHA256)
+	}
+	if v := metaValue(meta.UserMetadata, metaOptimized); v != "true" {
+		t.Errorf("expected the backup to be optimized, got %q", v)
+	}
+	oi, err := ms.Stat(context.Background(), bkp.key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := oi.Metadata.Get("Content-Type"); ct == "" {
+		t.Error("expected a content type")
+	}
+	if cd := oi.Metadata.Get("Content-Disposition"); cd != bkp.contentDisposition() {
+		t.Errorf("expected content disposition %q, got %q", bkp.contentDisposition(), cd)
+	}
+	if want := map[string]string{"env": "prod"}; !reflect.DeepEqual(map[string]string(oi.UserTags), want) {
+		t.Errorf("expected tags %v, got %v", want, oi.UserTags)
+	}
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -26,8 +27,8 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -40,11 +41,25 @@ const (
 	tmplDl = `Downloading %s {{ bar . "┃" "▓" "▓" "░" "┃"}} {{speed . "%%s/s" "? MiB/s"}}`
 )
 
+// exitCodeLXCNotFound - exit code when the lxc client is not installed,
+// same as shells use for a missing command.
+const exitCodeLXCNotFound = 127
+
 var globalFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		EnvVar: "LXMIN_CONFIG",
+		Usage:  "read unset global flags from this YAML file (default: $HOME/.lxmin/config.yaml)",
+	},
 	cli.StringFlag{
 		Name:   "endpoint",
 		EnvVar: "LXMIN_ENDPOINT",
-		Usage:  "endpoint for MinIO server",
+		Usage:  "endpoint for MinIO server, a comma separated list fails over to the next endpoint",
+	},
+	cli.BoolTFlag{
+		Name:   "assume-https",
+		EnvVar: "LXMIN_ASSUME_HTTPS",
+		Usage:  "use https for an endpoint without a scheme, set to false to require a scheme",
 	},
 	cli.StringFlag{
 		Name:   "bucket",
@@ -61,6 +76,16 @@ var globalFlags = []cli.Flag{
 		EnvVar: "LXMIN_SECRET_KEY",
 		Usage:  "secret key credential",
 	},
+	cli.StringFlag{
+		Name:   "encrypt-key",
+		EnvVar: "LXMIN_SSE_C_KEY",
+		Usage:  "encrypt backups with SSE-C using a 32 byte (or base64 encoded) key, the same key is needed to restore",
+	},
+	cli.StringFlag{
+		Name:   "sse-kms-key-id",
+		EnvVar: "LXMIN_SSE_KMS_KEY_ID",
+		Usage:  "encrypt backups with SSE-KMS using this KMS key id",
+	},
 	cli.StringFlag{
 		Name:   "address",
 		EnvVar: "LXMIN_ADDRESS",
@@ -81,16 +106,96 @@ var globalFlags = []cli.Flag{
 		EnvVar: "LXMIN_TLS_CAPATH",
 		Usage:  "TLS trust certs for incoming clients",
 	},
+	cli.StringFlag{
+		Name:   "api-token",
+		EnvVar: "LXMIN_API_TOKEN",
+		Usage:  "authenticate REST API clients with this bearer token instead of TLS client certificates",
+	},
 	cli.StringFlag{
 		Name:   "notify-endpoint",
 		EnvVar: "LXMIN_NOTIFY_ENDPOINT",
 		Usage:  "HTTP(S) POST endpoint to send notifications for REST API",
 	},
+	cli.IntFlag{
+		Name:   "notify-retries",
+		EnvVar: "LXMIN_NOTIFY_RETRIES",
+		Value:  3,
+		Usage:  "retry notifications this many times with backoff on network errors and 5xx responses",
+	},
+	cli.DurationFlag{
+		Name:   "notify-timeout",
+		EnvVar: "LXMIN_NOTIFY_TIMEOUT",
+		Value:  10 * time.Second,
+		Usage:  "timeout of each notification attempt, 0 to disable",
+	},
 	cli.StringFlag{
 		Name:   "staging",
 		EnvVar: "LXMIN_STAGING_ROOT",
 		Usage:  "root path for staging the backups before uploading to MinIO",
 	},
+	cli.StringFlag{
+		Name:   "staging-low-space",
+		EnvVar: "LXMIN_STAGING_LOW_SPACE",
+		Value:  "10GiB",
+		Usage:  "report low staging space in the health check below this free space, 0 to disable",
+	},
+	cli.DurationFlag{
+		Name:   "endpoint-health-timeout",
+		EnvVar: "LXMIN_ENDPOINT_HEALTH_TIMEOUT",
+		Value:  5 * time.Second,
+		Usage:  "fail fast if MinIO endpoint is not reachable within this duration, 0 to disable",
+	},
+	cli.BoolFlag{
+		Name:   "read-only",
+		EnvVar: "LXMIN_READ_ONLY",
+		Usage:  "reject backup, restore and delete requests to the REST API, toggle with SIGUSR1",
+	},
+	cli.BoolFlag{
+		Name:   "self-notify",
+		EnvVar: "LXMIN_SELF_NOTIFY",
+		Usage:  "record notifications in memory and serve them on /1.0/events, for demos and testing",
+	},
+	cli.BoolFlag{
+		Name:   "probe-only",
+		EnvVar: "LXMIN_PROBE_ONLY",
+		Usage:  "run the service startup checks and exit without listening",
+	},
+	cli.IntFlag{
+		Name:   "max-backups-per-instance",
+		EnvVar: "LXMIN_MAX_BACKUPS_PER_INSTANCE",
+		Usage:  "maximum backups per instance allowed via REST API, 0 for unlimited",
+	},
+	cli.IntFlag{
+		Name:   "import-retries",
+		EnvVar: "LXMIN_IMPORT_RETRIES",
+		Value:  3,
+		Usage:  "retry 'lxc import' this many times on transient daemon errors, name conflicts are never retried",
+	},
+	cli.DurationFlag{
+		Name:   "lxc-timeout",
+		EnvVar: "LXMIN_LXC_TIMEOUT",
+		Usage:  "kill lxc commands, e.g. a hung 'lxc export', running longer than this duration, 0 to disable",
+	},
+	cli.StringFlag{
+		Name:   "max-object-size",
+		EnvVar: "LXMIN_MAX_OBJECT_SIZE",
+		Usage:  "refuse to restore or download backups larger than this size, e.g. '500GiB', 0 for unlimited",
+	},
+	cli.BoolFlag{
+		Name:   "strict",
+		EnvVar: "LXMIN_STRICT",
+		Usage:  "refuse backups without lxmin schema version and kind metadata instead of recognizing legacy backups by name",
+	},
+	cli.BoolFlag{
+		Name:   "dereference-symlinks",
+		EnvVar: "LXMIN_DEREFERENCE_SYMLINKS",
+		Usage:  "resolve symlinks in staging root and reject staging paths outside of it",
+	},
+	cli.BoolFlag{
+		Name:   "incus",
+		EnvVar: "LXMIN_USE_INCUS",
+		Usage:  "run 'incus' instead of 'lxc', with the same commands and arguments",
+	},
 }
 
 var helpTemplate = `NAME:
@@ -115,6 +220,15 @@ var appCmds = []cli.Command{
 	infoCmd,
 	listCmd,
 	deleteCmd,
+	scheduleCmd,
+	pruneCmd,
+	repairCmd,
+	verifyCmd,
+	tagsCmd,
+	downloadCmd,
+	configCheckCmd,
+	startCmd,
+	debugCmd,
 }
 
 func authenticateTLSClientHandler(h http.Handler) http.Handler {
@@ -171,6 +285,59 @@ func authenticateTLSClientHandler(h http.Handler) http.Handler {
 	})
 }
 
+// authenticateTokenHandler - authenticates requests with a static bearer
+// token, as a simpler alternative to TLS client certificates.
+func authenticateTokenHandler(token string) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				Unauthorized(errors.New("missing or invalid bearer token")).Render(w)
+				return
+			}
+
+			if err := r.ParseForm(); err != nil {
+				writeErrorResponse(w, err)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newRouter - routes of the REST API, behind the client certificate or
+// the bearer token authentication.
+func newRouter(selfNotify bool) *mux.Router {
+	r := mux.NewRouter()
+	r.StrictSlash(false)
+	r.SkipClean(true)
+
+	r.HandleFunc("/1.0/instances/{name}/backups", listHandler).Methods(http.MethodGet)
+	r.HandleFunc("/1.0/instances/{name}/backups", readOnlyHandler(backupHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", infoHandler).Methods(http.MethodGet)
+	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", readOnlyHandler(deleteHandler)).Methods(http.MethodDelete)
+	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", readOnlyHandler(restoreHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/1.0/health", healthHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/metrics", metricsHandler).Methods(http.MethodGet)
+	if selfNotify {
+		globalEvents = &eventLog{}
+		r.HandleFunc("/1.0/events", postEventsHandler).Methods(http.MethodPost)
+		r.HandleFunc("/1.0/events", listEventsHandler).Methods(http.MethodGet)
+	}
+	if globalContext.APIToken != "" {
+		r.Use(authenticateTokenHandler(globalContext.APIToken))
+	} else {
+		r.Use(authenticateTLSClientHandler)
+	}
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NotFound(nil).Render(w)
+	})
+	return r
+}
+
 func mainHTTP(c *cli.Context) error {
 	if c.Args().Present() {
 		// With args present no need to start lxmin service.
@@ -180,21 +347,35 @@ func mainHTTP(c *cli.Context) error {
 		return errors.New("address cannot be empty please use '--address=:8000' to start lxmin as service")
 	}
 
+	if c.Bool("probe-only") {
+		return probeService(c)
+	}
+
 	if err := setGlobalsFromContext(c); err != nil {
 		return err
 	}
 
-	r := mux.NewRouter()
-	r.StrictSlash(false)
-	r.SkipClean(true)
+	globalReadOnly.Store(c.Bool("read-only"))
+	if globalReadOnly.Load() {
+		log.Println("WARNING: lxmin is in read-only mode, backup, restore and delete are disabled")
+	}
 
-	r.HandleFunc("/1.0/instances/{name}/backups", listHandler).Methods(http.MethodGet)
-	r.HandleFunc("/1.0/instances/{name}/backups", backupHandler).Methods(http.MethodPost)
-	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", infoHandler).Methods(http.MethodGet)
-	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", deleteHandler).Methods(http.MethodDelete)
-	r.HandleFunc("/1.0/instances/{name}/backups/{backup}", restoreHandler).Methods(http.MethodPost)
-	r.HandleFunc("/1.0/health", healthHandler).Methods(http.MethodGet, http.MethodHead)
-	r.Use(authenticateTLSClientHandler)
+	// Toggle read-only mode without a restart.
+	usrCh := make(chan os.Signal, 1)
+	notifyReadOnlyToggle(usrCh)
+	go func() {
+		for range usrCh {
+			readOnly := !globalReadOnly.Load()
+			globalReadOnly.Store(readOnly)
+			if readOnly {
+				log.Println("WARNING: read-only mode enabled, backup, restore and delete are disabled")
+			} else {
+				log.Println("Read-only mode disabled")
+			}
+		}
+	}()
+
+	r := newRouter(ctxBool(c, "self-notify"))
 
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
@@ -204,10 +385,6 @@ func mainHTTP(c *cli.Context) error {
 		ClientAuth:               tls.RequestClientCert,
 	}
 
-	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		NotFound(nil).Render(w)
-	})
-
 	srv := &http.Server{
 		Handler:     handlers.CompressHandler(handlers.LoggingHandler(os.Stdout, handlers.ProxyHeaders(r))),
 		Addr:        c.String("address"),
@@ -247,13 +424,18 @@ func mainHTTP(c *cli.Context) error {
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
 
+	// Backups run past the requests that started them, let the
+	// receivers know about those that did not finish.
+	globalBackupState.interrupt()
+
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
 	return nil
 }
 
-func main() {
+// newApp - builds the lxmin CLI application.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Copyright = "MinIO, Inc."
 	app.Usage = "backup and restore LXC instances with MinIO"
@@ -266,14 +448,25 @@ func main() {
 		if c.Bool("help") {
 			cli.ShowAppHelpAndExit(c, 0) // last argument is exit code
 		}
-		_, err := exec.LookPath("lxc")
-		return err
+		// Commands select the client in their own Before, `--incus` may
+		// follow the command name.
+		if c.App.Command(c.Args().First()) != nil {
+			return nil
+		}
+		// The config file may select incus.
+		if _, err := applyConfig(c); err != nil {
+			return err
+		}
+		return setLXCOptions(c)
 	}
 
 	// Start http service if configured.
 	app.Action = mainHTTP
+	return app
+}
 
-	if err := app.Run(os.Args); err != nil {
+func main() {
+	if err := newApp().Run(os.Args); err != nil {
 		log.Fatalln(err)
 	}
 }
@@ -0,0 +1,35 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/minio/cli"
+)
+
+// runCommand - runs the command with the arguments against the test
+// context, its globals are not set from the command line.
+func runCommand(t *testing.T, cmd cli.Command, args ...string) error {
+	t.Helper()
+	cmd.Before = nil
+	app := cli.NewApp()
+	app.Name = "lxmin"
+	app.Commands = []cli.Command{cmd}
+	return app.Run(append([]string{"lxmin", cmd.Name}, args...))
+}
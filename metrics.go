@@ -0,0 +1,174 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// opMetrics - counters and duration histogram of one operation type.
+type opMetrics struct {
+	started, succeeded, failed atomic.Int64
+	duration                   *histogram
+}
+
+// histogram - cumulative histogram in the Prometheus sense, counts[i]
+// is the number of observations less than or equal to buckets[i].
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics - service metrics served on /metrics, kept apart from any
+// global registry so only lxmin metrics are exposed.
+type metrics struct {
+	backups, restores opMetrics
+
+	bytesUploaded   atomic.Int64
+	bytesDownloaded atomic.Int64
+}
+
+// Operation duration buckets in seconds, from a minute to a day.
+var durationBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+
+var globalMetrics = &metrics{
+	backups:  opMetrics{duration: newHistogram(durationBuckets...)},
+	restores: opMetrics{duration: newHistogram(durationBuckets...)},
+}
+
+// observeEvent - counts the state transitions of backups and restores,
+// as sent to the notification endpoint.
+func (m *metrics) observeEvent(e eventInfo) {
+	var op *opMetrics
+	switch e.OpType {
+	case Backup:
+		op = &m.backups
+	case Restore:
+		op = &m.restores
+	default:
+		return
+	}
+
+	switch e.State {
+	case Started:
+		op.started.Add(1)
+	case Success:
+		op.succeeded.Add(1)
+		if e.StartedAt != nil && e.CompletedAt != nil {
+			op.duration.observe(e.CompletedAt.Sub(*e.StartedAt).Seconds())
+		}
+	case Failed:
+		op.failed.Add(1)
+		if e.StartedAt != nil && e.FailedAt != nil {
+			op.duration.observe(e.FailedAt.Sub(*e.StartedAt).Seconds())
+		}
+	}
+}
+
+func (s *backupState) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.backups)
+}
+
+// writeMetric - writes a metric in the Prometheus text format.
+func writeMetric(w *bufio.Writer, name, typ, help string, samples ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s\n", name, sample)
+	}
+}
+
+func (h *histogram) samples(labels string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var samples []string
+	for i, le := range h.buckets {
+		samples = append(samples, fmt.Sprintf("_bucket{%s,le=\"%s\"} %d", labels, strconv.FormatFloat(le, 'f', -1, 64), h.counts[i]))
+	}
+	samples = append(samples,
+		fmt.Sprintf("_bucket{%s,le=\"+Inf\"} %d", labels, h.count),
+		fmt.Sprintf("_sum{%s} %s", labels, strconv.FormatFloat(h.sum, 'f', -1, 64)),
+		fmt.Sprintf("_count{%s} %d", labels, h.count),
+	)
+	return samples
+}
+
+// metricsHandler - serves the service metrics in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := globalMetrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, op := range []struct {
+		name string
+		m    *opMetrics
+	}{{Backup, &m.backups}, {Restore, &m.restores}} {
+		writeMetric(bw, "lxmin_"+op.name+"s_total", "counter", "Number of "+op.name+"s by state.",
+			fmt.Sprintf("{state=%q} %d", Started, op.m.started.Load()),
+			fmt.Sprintf("{state=%q} %d", Success, op.m.succeeded.Load()),
+			fmt.Sprintf("{state=%q} %d", Failed, op.m.failed.Load()),
+		)
+		writeMetric(bw, "lxmin_"+op.name+"_duration_seconds", "histogram", "Duration of finished "+op.name+"s in seconds.",
+			op.m.duration.samples(fmt.Sprintf("op=%q", op.name))...)
+	}
+
+	restoresInFlight := m.restores.started.Load() - m.restores.succeeded.Load() - m.restores.failed.Load()
+	writeMetric(bw, "lxmin_operations_in_flight", "gauge", "Number of backups and restores in progress.",
+		fmt.Sprintf("{op=%q} %d", Backup, globalBackupState.Len()),
+		fmt.Sprintf("{op=%q} %d", Restore, restoresInFlight),
+	)
+	writeMetric(bw, "lxmin_uploaded_bytes_total", "counter", "Bytes uploaded to MinIO by backups.",
+		fmt.Sprintf(" %d", m.bytesUploaded.Load()))
+	writeMetric(bw, "lxmin_downloaded_bytes_total", "counter", "Bytes downloaded from MinIO by restores.",
+		fmt.Sprintf(" %d", m.bytesDownloaded.Load()))
+	if free, err := stagingFree(); err == nil {
+		writeMetric(bw, "lxmin_staging_free_bytes", "gauge", "Free space on the staging root in bytes.",
+			fmt.Sprintf(" %d", free))
+	}
+}
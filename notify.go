@@ -19,10 +19,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -37,6 +40,10 @@ const (
 	Failed  = "failed"
 	Success = "success"
 	Started = "started"
+	Skipped = "skipped"
+
+	// Interrupted - the service shut down before the operation finished.
+	Interrupted = "interrupted"
 )
 
 type eventInfo struct {
@@ -49,19 +56,101 @@ type eventInfo struct {
 	FailedAt    *time.Time `json:"failedAt,omitempty"`
 	RawURL      string     `json:"rawURL,omitempty"`
 	Error       error      `json:"error,omitempty"`
+
+	// Set on success only.
+	Size      int64             `json:"size,omitempty"`
+	Optimized bool              `json:"optimized,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Bucket    string            `json:"bucket,omitempty"`
+	ObjectKey string            `json:"objectKey,omitempty"`
 }
 
 func notifyEvent(e eventInfo, endpoint string) {
+	globalMetrics.observeEvent(e)
+	globalEvents.observe(e)
+
+	if endpoint == "" {
+		// Notifications are optional outside of the REST API.
+		return
+	}
+
 	data, err := json.Marshal(&e)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	for attempt := 0; ; attempt++ {
+		retry, err := postEvent(endpoint, data)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= globalContext.NotifyRetries {
+			log.Println(err)
+			return
+		}
+		// Re-resolve the endpoint, it may have failed over.
+		globalContext.NotifyClnt.CloseIdleConnections()
+		time.Sleep(notifyBackoff(attempt))
+	}
+}
+
+const (
+	// Idle connections to the notification endpoint are closed after
+	// notifyIdleConnTimeout, and all of them every notifyConnLifetime,
+	// new connections resolve the endpoint again and so follow failover.
+	notifyIdleConnTimeout = 30 * time.Second
+	notifyConnLifetime    = 5 * time.Minute
+)
+
+// recyclingTransport - closes the idle connections of the transport every
+// lifetime, connections busy at that time are left to the next recycle
+// or to the idle timeout.
+type recyclingTransport struct {
+	*http.Transport
+	lifetime time.Duration
+
+	mu       sync.Mutex
+	recycled time.Time
+}
+
+func (t *recyclingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if now := time.Now(); now.Sub(t.recycled) > t.lifetime {
+		if !t.recycled.IsZero() {
+			t.Transport.CloseIdleConnections()
+		}
+		t.recycled = now
+	}
+	t.mu.Unlock()
+
+	return t.Transport.RoundTrip(req)
+}
+
+// Base delay between notification attempts, doubled on every retry.
+var notifyRetryDelay = 500 * time.Millisecond
+
+// notifyBackoff - delay before retrying a notification, exponential
+// with up to 50% jitter so receivers recovering from an outage are not
+// hit by all senders at once.
+func notifyBackoff(attempt int) time.Duration {
+	d := notifyRetryDelay << attempt
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// postEvent - sends the event once within --notify-timeout, network
+// errors and 5xx responses are retryable.
+func postEvent(endpoint string, data []byte) (retry bool, err error) {
+	ctx := context.Background()
+	if timeout := globalContext.NotifyTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
 	if err != nil {
-		log.Println(err)
-		return
+		return false, err
 	}
 
 	// Set proper content type.
@@ -69,13 +158,12 @@ func notifyEvent(e eventInfo, endpoint string) {
 
 	resp, err := globalContext.NotifyClnt.Do(req)
 	if err != nil {
-		log.Println(err)
-		return
+		return true, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Println(fmt.Sprintf("notification endpoint returned error: %s", resp.Status))
-		return
+		return resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("notification endpoint returned error: %s", resp.Status)
 	}
+	return false, nil
 }
@@ -0,0 +1,78 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifyServer - serves the notification endpoint with the given status
+// codes, one per attempt, then 200. Returns the number of attempts made.
+func notifyServer(t *testing.T, codes ...int) (endpoint string, attempts *int32) {
+	t.Helper()
+	attempts = new(int32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(attempts, 1)
+		if int(n) <= len(codes) {
+			w.WriteHeader(codes[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+
+	newTestContext(t)
+	globalContext.NotifyClnt = srv.Client()
+	globalContext.NotifyRetries = 3
+	globalContext.NotifyTimeout = time.Second
+
+	prev := notifyRetryDelay
+	notifyRetryDelay = time.Millisecond
+	t.Cleanup(func() { notifyRetryDelay = prev })
+	return srv.URL, attempts
+}
+
+func TestNotifyEventRetry(t *testing.T) {
+	endpoint, attempts := notifyServer(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	notifyEvent(eventInfo{OpType: Backup, State: Success, Name: "b1", Instance: "u1"}, endpoint)
+	if n := atomic.LoadInt32(attempts); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestNotifyEventNoRetryOn4xx(t *testing.T) {
+	endpoint, attempts := notifyServer(t, http.StatusBadRequest)
+	notifyEvent(eventInfo{OpType: Backup, State: Success, Name: "b1", Instance: "u1"}, endpoint)
+	if n := atomic.LoadInt32(attempts); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+}
+
+func TestNotifyEventRetriesExhausted(t *testing.T) {
+	endpoint, attempts := notifyServer(t, http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	notifyEvent(eventInfo{OpType: Backup, State: Success, Name: "b1", Instance: "u1"}, endpoint)
+	// The first attempt and --notify-retries retries.
+	if n := atomic.LoadInt32(attempts); n != 4 {
+		t.Fatalf("expected 4 attempts, got %d", n)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/minio/cli"
+)
+
+type probeCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type probeReport struct {
+	OK     bool         `json:"ok"`
+	Checks []probeCheck `json:"checks"`
+}
+
+func (p *probeReport) add(name string, err error) {
+	check := probeCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		p.OK = false
+	}
+	p.Checks = append(p.Checks, check)
+}
+
+// probeService - runs all the service startup checks, prints a JSON report
+// and returns an error if any of them failed. Used with `--probe-only` to
+// validate the configuration without listening.
+func probeService(c *cli.Context) error {
+	report := probeReport{OK: true}
+	defer func() {
+		json.NewEncoder(os.Stdout).Encode(&report)
+	}()
+
+	if err := setGlobalsFromContext(c); err != nil {
+		report.add("config", err)
+		return errors.New("probe failed")
+	}
+	report.add("config", nil)
+
+	if globalContext.TLSCerts == nil {
+		report.add("tls", errors.New("no TLS server certificate configured"))
+	} else {
+		report.add("tls", nil)
+	}
+
+	exists, err := globalContext.Store.BucketExists(context.Background())
+	report.add("minio", err)
+	if err == nil && !exists {
+		err = fmt.Errorf("bucket '%s' does not exist", globalContext.Bucket)
+	}
+	report.add("bucket", err)
+
+	_, err = exec.LookPath(lxcBinary)
+	report.add(lxcBinary, err)
+
+	if !report.OK {
+		return errors.New("probe failed")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone - reports if the process exited, a zombie waiting to be
+// reaped is gone too.
+func processGone(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	// The state follows the parenthesized command name.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestRunLXCTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// A hung lxc command, waiting on a child that keeps its stderr open.
+	fakeLXC(t, "sleep 30 &\necho $! > "+pidFile+"\nwait\n")
+	prev := lxcTimeout
+	lxcTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { lxcTimeout = prev })
+
+	var errBuf bytes.Buffer
+	cmd := lxcCommand("export", "u1")
+	cmd.Stderr = &errBuf
+	start := time.Now()
+	err := runLXC(cmd)
+	if !errors.Is(err, errLXCTimeout) {
+		t.Fatalf("expected %v, got %v", errLXCTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the command to be killed after %s, took %s", lxcTimeout, elapsed)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !processGone(pid); {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("expected the child %d of the lxc command to be killed", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "os/exec"
+
+// setProcessGroup - process groups are not available on windows, only
+// the command itself is killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup - kills the command.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/minio/cli"
+)
+
+var pruneFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "keep-last",
+		Usage: "keep this many most recent backups per instance",
+	},
+	cli.DurationFlag{
+		Name:  "older-than",
+		Usage: "delete backups older than this duration, e.g. 720h",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the backups that would be deleted without deleting them",
+	},
+}
+
+var pruneCmd = cli.Command{
+	Name:   "prune",
+	Usage:  "delete backups outside of a retention policy",
+	Action: pruneMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(pruneFlags, globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME
+
+TIP:
+   With both --keep-last and --older-than, a backup is only deleted when
+   neither keeps it.
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Keep only the last 7 backups of instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2 --keep-last 7
+  2. Show which backups older than 30 days would be deleted for all instances:
+     {{.Prompt}} {{.HelpName}} '*' --older-than 720h --dry-run
+`,
+}
+
+func pruneMain(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	if instance == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+	// Allow '*' for all instances, same as list.
+	if instance == "*" {
+		instance = ""
+	}
+	if err := validateNames(instance, ""); err != nil {
+		return err
+	}
+
+	keepLast := c.Int("keep-last")
+	olderThan := c.Duration("older-than")
+	if keepLast < 0 || olderThan < 0 {
+		return errors.New("--keep-last and --older-than cannot be negative")
+	}
+	if keepLast == 0 && olderThan == 0 {
+		return errors.New("please provide a retention policy with --keep-last and/or --older-than")
+	}
+
+	backups, err := globalContext.ListBackups(instance)
+	if err != nil {
+		return err
+	}
+
+	for _, bkp := range backupsToPrune(backups, keepLast, olderThan, time.Now()) {
+		if c.Bool("dry-run") {
+			fmt.Printf("Would delete backup '%s' of instance '%s'\n", bkp.Name, bkp.Instance)
+			continue
+		}
+		di, err := globalContext.DeleteBackup(backup{instance: bkp.Instance, backupName: bkp.Name})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted backup '%s' of instance '%s' (%d objects, %s)\n", bkp.Name, bkp.Instance, di.Objects, humanize.IBytes(uint64(di.Freed)))
+	}
+	return nil
+}
+
+// backupsToPrune - returns the backups outside of the retention policy.
+// Per instance, the keepLast most recent backups and those not older
+// than olderThan are kept, a zero value disables the rule.
+func backupsToPrune(backups []backupInfo, keepLast int, olderThan time.Duration, now time.Time) []backupInfo {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(*backups[j].Created)
+	})
+
+	var prune []backupInfo
+	seen := map[string]int{}
+	for _, bkp := range backups {
+		seen[bkp.Instance]++
+		if keepLast > 0 && seen[bkp.Instance] <= keepLast {
+			continue
+		}
+		if olderThan > 0 && now.Sub(*bkp.Created) <= olderThan {
+			continue
+		}
+		prune = append(prune, bkp)
+	}
+	return prune
+}
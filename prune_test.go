@@ -0,0 +1,117 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupsToPrune(t *testing.T) {
+	now := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	at := func(d time.Duration) *time.Time {
+		created := now.Add(-d)
+		return &created
+	}
+	backups := []backupInfo{
+		{Instance: "u1", Name: "b1", Created: at(40 * day)},
+		{Instance: "u1", Name: "b2", Created: at(20 * day)},
+		{Instance: "u1", Name: "b3", Created: at(1 * day)},
+		{Instance: "u2", Name: "b1", Created: at(50 * day)},
+	}
+
+	testCases := []struct {
+		keepLast  int
+		olderThan time.Duration
+		want      []string
+	}{
+		{keepLast: 1, want: []string{"u1/b2", "u1/b1"}},
+		{keepLast: 2, want: []string{"u1/b1"}},
+		// More than the backups of every instance.
+		{keepLast: 10, want: []string{}},
+		{olderThan: 30 * day, want: []string{"u1/b1", "u2/b1"}},
+		{olderThan: 10 * day, want: []string{"u1/b2", "u1/b1", "u2/b1"}},
+		// A backup is only deleted when neither rule keeps it.
+		{keepLast: 2, olderThan: 10 * day, want: []string{"u1/b1"}},
+		{keepLast: 1, olderThan: 30 * day, want: []string{"u1/b1"}},
+	}
+	for _, tc := range testCases {
+		got := backupNames(backupsToPrune(append([]backupInfo{}, backups...), tc.keepLast, tc.olderThan, now))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("keep last %d, older than %s: expected %v, got %v", tc.keepLast, tc.olderThan, tc.want, got)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ms := newTestContext(t)
+	for _, name := range []string{"b1", "b2", "b3"} {
+		putTestBackup(t, ms, testBackup{instance: "u1", name: name, profiles: []string{"default", "web"}})
+	}
+	putTestBackup(t, ms, testBackup{instance: "u2", name: "b1", profiles: []string{"default"}})
+	all := ms.keys()
+
+	// Nothing is deleted with --dry-run, nor when keeping more backups
+	// than there are.
+	if err := runCommand(t, pruneCmd, "--keep-last", "1", "--dry-run", "*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(t, pruneCmd, "--keep-last", "5", "*"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, all) {
+		t.Fatalf("expected no objects to be deleted, got %v", got)
+	}
+
+	// The profiles and the manifest go along with the instance tarball.
+	if err := runCommand(t, pruneCmd, "--keep-last", "1", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"u1/b3_instance.tar.gz",
+		"u1/b3_manifest.json",
+		"u1/b3_profile_000_default.yaml",
+		"u1/b3_profile_001_web.yaml",
+		"u2/b1_instance.tar.gz",
+		"u2/b1_manifest.json",
+		"u2/b1_profile_000_default.yaml",
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// The test backups are from 2024.
+	if err := runCommand(t, pruneCmd, "--older-than", "720h", "*"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ms.keys(); len(got) != 0 {
+		t.Fatalf("expected all objects to be deleted, got %v", got)
+	}
+}
+
+func TestPruneNoPolicy(t *testing.T) {
+	newTestContext(t)
+	if err := runCommand(t, pruneCmd, "u1"); err == nil {
+		t.Error("expected an error without a retention policy")
+	}
+	if err := runCommand(t, pruneCmd, "--keep-last", "-1", "u1"); err == nil {
+		t.Error("expected an error with a negative --keep-last")
+	}
+}
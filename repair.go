@@ -0,0 +1,180 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/cli"
+	"github.com/minio/minio-go/v7"
+)
+
+var repairCmd = cli.Command{
+	Name:   "repair",
+	Usage:  "re-upload missing profiles of a backup from the profiles on this host",
+	Action: repairMain,
+	Before: setGlobalsFromContext,
+	Flags:  globalFlags,
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME BACKUPNAME
+
+TIP:
+   Profiles are only re-uploaded when they are unchanged since the backup,
+   as recorded in the backup manifest.
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Complete backup 'backup_2022-02-16-04-1040' for instance 'u2' with its missing profiles:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040
+`,
+}
+
+func repairMain(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	if instance == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if instance == "*" {
+		return errWildcardInstance
+	}
+
+	backupName := strings.TrimSpace(c.Args().Get(1))
+	if backupName == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if err := validateNames(instance, backupName); err != nil {
+		return err
+	}
+
+	bkp := globalContext.resolveBackup(backup{instance: instance, backupName: backupName})
+	repaired, err := globalContext.repairBackup(bkp)
+	if err != nil {
+		return err
+	}
+	if len(repaired) == 0 {
+		fmt.Printf("Backup %s is complete, nothing to repair\n", backupName)
+		return nil
+	}
+	fmt.Printf("Repaired backup %s, uploaded profiles: %s\n", backupName, strings.Join(repaired, ", "))
+	return nil
+}
+
+// missingProfiles - returns the manifest entries of the profiles whose
+// objects are missing from the backup.
+func (l *lxminContext) missingProfiles(bkp backup, m *backupManifest) ([]manifestProfile, error) {
+	var missing []manifestProfile
+	for _, mp := range m.Profiles {
+		key := path.Join(bkp.instance, mp.Object)
+		_, err := l.Store.Stat(context.Background(), key)
+		if err == nil {
+			continue
+		}
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return nil, fmt.Errorf("Unable to stat profile %s: %v", key, err)
+		}
+		missing = append(missing, mp)
+	}
+	return missing, nil
+}
+
+// repairBackup - re-exports the profiles missing from the backup and
+// uploads them, returning the names of the uploaded profiles. Every
+// missing profile is exported and compared with the checksum in the
+// manifest before anything is uploaded, so that a backup is never
+// completed with profiles that changed since it was made.
+func (l *lxminContext) repairBackup(bkp backup) ([]string, error) {
+	m, err := l.getManifest(bkp)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("Backup %s has no manifest, unable to tell which profiles are missing", bkp.backupName)
+	}
+
+	missing, err := l.missingProfiles(bkp, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	// Tag the profiles like the rest of the backup.
+	tags, err := l.GetTags(bkp)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch tags of backup %s: %v", bkp.backupName, err)
+	}
+	bopts := backupOpts{TagsSet: tags}
+
+	fpaths := make([]string, len(missing))
+	defer func() {
+		for _, fpath := range fpaths {
+			if fpath != "" {
+				os.Remove(fpath)
+			}
+		}
+	}()
+	for i, mp := range missing {
+		fpath, err := l.stagingPath(mp.Object)
+		if err != nil {
+			return nil, err
+		}
+		fpaths[i] = fpath
+
+		if _, err := exportProfile(mp.Name, fpath); err != nil {
+			return nil, fmt.Errorf("Unable to export profile %s from this host: %v", mp.Name, err)
+		}
+		sum, err := fileSHA256(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to checksum profile file %s: %v", fpath, err)
+		}
+		if sum != mp.SHA256 {
+			return nil, fmt.Errorf("Profile %s has changed since backup %s was made, refusing to repair", mp.Name, bkp.backupName)
+		}
+	}
+
+	var repaired []string
+	for i, mp := range missing {
+		f, err := os.Open(fpaths[i])
+		if err != nil {
+			return repaired, err
+		}
+		err = l.Store.Put(context.Background(), path.Join(bkp.instance, mp.Object), f, mp.Size, bopts.profilePutOptions())
+		f.Close()
+		if err != nil {
+			return repaired, fmt.Errorf("Error uploading file %s: %v", fpaths[i], err)
+		}
+		repaired = append(repaired, mp.Name)
+	}
+	return repaired, nil
+}
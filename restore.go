@@ -19,6 +19,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -28,16 +29,68 @@ import (
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/cheggaaa/pb/v3"
+	"github.com/dustin/go-humanize"
 	"github.com/minio/cli"
 	"github.com/minio/minio-go/v7/pkg/set"
 )
 
+var restoreFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "skip-profiles",
+		Usage: "do not restore profiles, only warn about the profiles the instance expects",
+	},
+	cli.BoolFlag{
+		Name:  "verify-profiles",
+		Usage: "read back restored profiles and verify they match the backup",
+	},
+	cli.BoolFlag{
+		Name:  "overwrite-profiles",
+		Usage: "replace existing profiles with their definition from the backup instead of skipping them",
+	},
+	cli.BoolFlag{
+		Name:  "import-stopped, no-start",
+		Usage: "import the instance but leave it stopped, start it later with 'lxmin start'",
+	},
+	cli.BoolFlag{
+		Name:  "allow-missing-profiles",
+		Usage: "restore the instance even if profiles are missing from the backup, without them",
+	},
+	cli.StringFlag{
+		Name:  "as",
+		Usage: "restore the backup as a new instance by this name, leaving the original instance untouched",
+	},
+	cli.BoolFlag{
+		Name:  "stream",
+		Usage: "pipe the instance backup from MinIO into 'lxc import' without staging it, optimized backups are staged",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print what would be downloaded and restored, without downloading or importing",
+	},
+	cli.StringFlag{
+		Name:  "to-project",
+		Usage: "restore the instance and its profiles into this LXD project instead of the default project",
+	},
+	cli.BoolFlag{
+		Name:  "create-project",
+		Usage: "create the project of --to-project if it does not exist",
+	},
+	cli.StringFlag{
+		Name:  "storage",
+		Usage: "import the instance into this storage pool instead of the pool it was backed up from",
+	},
+	cli.BoolFlag{
+		Name:  "force",
+		Usage: "restore a backup that was interrupted before all of its files were uploaded",
+	},
+}
+
 var restoreCmd = cli.Command{
 	Name:   "restore",
 	Usage:  "restore an instance image from MinIO",
 	Action: restoreMain,
 	Before: setGlobalsFromContext,
-	Flags:  globalFlags,
+	Flags:  append(restoreFlags, globalFlags...),
 	CustomHelpTemplate: `NAME:
   {{.HelpName}} - {{.Usage}}
 
@@ -50,6 +103,26 @@ FLAGS:
 EXAMPLES:
   1. Restore an instance 'u2' from a backup 'backup_2022-02-16-04-1040':
      {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040
+  2. Restore an instance 'u2' without touching profiles on the host:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --skip-profiles
+  3. Stage a restore of instance 'u2' to be started at cutover:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --import-stopped
+  4. Clone a backup 'backup_2022-02-16-04-1040' of instance 'u2' into a new instance 'u2-clone':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --as u2-clone
+  5. Salvage instance 'u2' from a backup 'backup_2022-02-16-04-1040' whose profiles were deleted:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --allow-missing-profiles
+  6. Restore an instance 'u2' on a host without staging space for the instance backup:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --stream
+  7. Migrate an instance 'u2' from a backup 'backup_2022-02-16-04-1040' into a new project 'staging':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --to-project staging --create-project
+  8. Restore an instance 'u3' on remote 'mylxdserver' from a backup 'backup_2022-02-16-04-1040':
+     {{.Prompt}} {{.HelpName}} mylxdserver:u3 backup_2022-02-16-04-1040
+  9. Print what a restore of instance 'u2' from a backup 'backup_2022-02-16-04-1040' would do:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --dry-run
+  10. Restore an instance 'u2' from a backup 'backup_2022-02-16-04-1040' into the storage pool 'fast':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --storage fast
+  11. Restore an instance 'u2' from a backup 'backup_2022-02-16-04-1040', reverting its profiles to the backup:
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040 --overwrite-profiles
 `,
 }
 
@@ -68,33 +141,201 @@ func restoreMain(c *cli.Context) error {
 		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
 	}
 
-	if err := checkInstance(instance); err != nil {
+	if err := validateNames(instance, backupName); err != nil {
 		return err
 	}
 
-	bkp := backup{instance: instance, backupName: backupName}
+	// Instances of the `remote:instance` form are restored on the remote.
+	remote, _ := splitRemote(instance)
+
+	// The original instance may exist when restoring under a new name.
+	target := strings.TrimSpace(c.String("as"))
+	restoredName := instance
+	if target != "" {
+		if err := validateNames(target, ""); err != nil {
+			return err
+		}
+		if strings.Contains(target, ":") {
+			return fmt.Errorf("--as takes an instance name, the instance is restored on the remote of '%s'", instance)
+		}
+		restoredName = remote + target
+	}
+
+	project := strings.TrimSpace(c.String("to-project"))
+	if project == "" && c.Bool("create-project") {
+		return errors.New("--create-project requires --to-project")
+	}
+	// A dry run does not create the project, nor look into it.
+	dryRun := c.Bool("dry-run")
+	newProject := project != "" && dryRun && c.Bool("create-project") && !projectExists(remote+project)
+	if project != "" && !newProject {
+		if err := ensureProject(remote+project, c.Bool("create-project")); err != nil {
+			return err
+		}
+	}
+	if !newProject {
+		if err := checkInstance(restoredName, project); err != nil {
+			return err
+		}
+	}
+
+	pool := strings.TrimSpace(c.String("storage"))
+	if pool != "" {
+		if strings.Contains(pool, ":") {
+			return fmt.Errorf("--storage takes a storage pool name, the instance is restored on the remote of '%s'", instance)
+		}
+		if !storagePoolExists(remote + pool) {
+			return fmt.Errorf("Storage pool '%s' does not exist", remote+pool)
+		}
+	}
+
+	bkp := globalContext.resolveBackup(backup{instance: instance, backupName: backupName})
+	if err := globalContext.checkComplete(bkp); err != nil {
+		if !errors.Is(err, errIncompleteBackup) {
+			return err
+		}
+		if !c.Bool("force") {
+			return fmt.Errorf("%v, use --force to restore it anyway", err)
+		}
+		fmt.Printf("⚠ %v\n", err)
+	}
 
 	// List and collect all backup related files.
-	resInfo := collectBackupInfo(globalContext, bkp)
+	resInfo, err := collectBackupInfo(globalContext, bkp, c.Bool("allow-missing-profiles"))
+	if err != nil {
+		return err
+	}
+	if len(resInfo.missing) > 0 {
+		fmt.Printf("⚠ Profiles missing from backup, they can not be restored: %s\n", strings.Join(resInfo.missing, ", "))
+	}
+
+	if dryRun {
+		return restoreDryRun(globalContext, bkp, resInfo, restoredName, project, pool, newProject, c.Bool("skip-profiles"), c.Bool("overwrite-profiles"))
+	}
+
+	ei, err := inspectExport(globalContext, bkp)
+	if err != nil {
+		fmt.Printf("⚠ %v\n", err)
+	}
+	if err := ei.checkOptimized(bkp, resInfo.optimized); err != nil {
+		fmt.Printf("⚠ %v\n", err)
+	}
+	if err := ei.checkPool(bkp, pool); err != nil {
+		fmt.Printf("⚠ %v\n", err)
+	}
+
+	skipProfiles := c.Bool("skip-profiles")
+	if skipProfiles && c.Bool("overwrite-profiles") {
+		return errors.New("--overwrite-profiles cannot be used with --skip-profiles")
+	}
+	if skipProfiles {
+		expected := resInfo.skipProfiles()
+		fmt.Printf("ⓘ Skipping profiles restore, instance '%s' expects profiles: %s\n", instance, strings.Join(expected, ", "))
+	}
+
+	stream := c.Bool("stream")
+	if stream && !resInfo.streamable() {
+		fmt.Println("ⓘ Backup is optimized, staging it before import")
+		stream = false
+	}
 
 	// Download all backup files to staging directory
-	err := downloadBackupFiles(globalContext, bkp, resInfo)
+	err = downloadBackupFiles(globalContext, bkp, resInfo, stream)
 	if err != nil {
 		return err
 	}
 
-	restoreProfiles(globalContext, instance, backupName, resInfo)
+	if !skipProfiles {
+		if err := restoreProfiles(globalContext, instance, backupName, project, resInfo, c.Bool("verify-profiles"), c.Bool("overwrite-profiles")); err != nil {
+			return err
+		}
+	}
+	if err := restoreVolumes(globalContext, instance, project, resInfo); err != nil {
+		return err
+	}
 
-	restoreInstanceCLI(globalContext, bkp)
+	iopts := importOpts{
+		target:  target,
+		project: project,
+		pool:    pool,
+		start:   !c.Bool("import-stopped"),
+	}
+	return restoreInstanceCLI(globalContext, bkp, iopts, stream)
+}
 
+// restoreDryRun - prints the objects a restore would download and the
+// profiles it would create or skip, without downloading anything or
+// running 'lxc import'.
+func restoreDryRun(ctx *lxminContext, bkp backup, resInfo restoreInfo, restoredName, project, pool string, newProject, skipProfiles, overwriteProfiles bool) error {
+	remote, _ := splitRemote(bkp.instance)
+	existingProfiles := set.NewStringSet()
+	if !newProject && !skipProfiles && len(resInfo.profiles) > 0 {
+		p, err := fetchExistingProfiles(remote, project)
+		if err != nil {
+			return err
+		}
+		existingProfiles = p
+	}
+
+	fmt.Printf("%-12s: %s\n", "Backup", path.Join(bkp.instance, bkp.backupName))
+	fmt.Printf("%-12s: %s\n", "Instance", restoredName)
+	if project != "" {
+		if newProject {
+			project += " (would be created)"
+		}
+		fmt.Printf("%-12s: %s\n", "Project", project)
+	}
+	if pool != "" {
+		fmt.Printf("%-12s: %s\n", "Storage", pool)
+	}
+	fmt.Printf("%-12s: %s\n", "Size", humanize.IBytes(uint64(resInfo.totalSize)))
+	fmt.Printf("%-12s:\n", "Objects")
+	fmt.Printf("  %s\n", bkp.key())
+	for _, key := range resInfo.profileKeys {
+		fmt.Printf("  %s\n", key)
+	}
+	for _, key := range resInfo.volumeKeys {
+		fmt.Printf("  %s\n", key)
+	}
+	fmt.Printf("%-12s:\n", "Profiles")
+	for _, pf := range resInfo.profiles {
+		switch {
+		case skipProfiles:
+			fmt.Printf("  %s (skipped, --skip-profiles)\n", pf)
+		case existingProfiles.Contains(pf) && overwriteProfiles:
+			fmt.Printf("  %s (overwritten, --overwrite-profiles)\n", pf)
+		case existingProfiles.Contains(pf):
+			fmt.Printf("  %s (skipped, already exists)\n", pf)
+		default:
+			fmt.Printf("  %s (created)\n", pf)
+		}
+	}
+	for _, pf := range resInfo.missing {
+		fmt.Printf("  %s (skipped, missing from backup)\n", pf)
+	}
+	if len(resInfo.volumes) > 0 {
+		fmt.Printf("%-12s:\n", "Volumes")
+	}
+	for _, mv := range resInfo.volumes {
+		if !newProject && volumeExists(remote, project, mv.volume()) {
+			fmt.Printf("  %s/%s (skipped, already exists)\n", mv.Pool, mv.Name)
+		} else {
+			fmt.Printf("  %s/%s (imported)\n", mv.Pool, mv.Name)
+		}
+	}
 	return nil
 }
 
-func restoreInstanceCLI(ctx *lxminContext, bkp backup) {
-	var lastCmd []string
+func restoreInstanceCLI(ctx *lxminContext, bkp backup, iopts importOpts, stream bool) error {
 	var outBuf *bytes.Buffer
 	restoreCmd := func() tea.Msg {
-		ob, err := restoreInstance(ctx, bkp)
+		var ob *bytes.Buffer
+		var err error
+		if stream {
+			ob, err = streamInstance(ctx, bkp, iopts, nil)
+		} else {
+			ob, err = restoreInstance(ctx, bkp, iopts)
+		}
 		if err != nil {
 			outBuf = ob
 			return err
@@ -102,21 +343,34 @@ func restoreInstanceCLI(ctx *lxminContext, bkp backup) {
 		return true
 	}
 
+	message := `%s Launching instance: %s`
+	if !iopts.start {
+		message = `%s Importing instance: %s`
+	}
+	instance := bkp.instance
+	if iopts.target != "" {
+		instance = iopts.target
+	}
 	sUI := initCmdSpinnerUI(
 		restoreCmd,
-		cOpts{instance: bkp.instance, message: `%s Launching instance: %s`},
+		cOpts{instance: instance, message: message, showElapsed: true},
 	)
 	if err := tea.NewProgram(sUI).Start(); err != nil {
-		log.Printf("Last command: `%s`", strings.Join(lastCmd, " "))
-		log.Printf("Output: %s", string(outBuf.Bytes()))
 		log.Fatalln(err)
 	}
+	if sUI.err != nil && outBuf != nil {
+		log.Printf("Output: %s", outBuf.String())
+	}
+	return sUI.err
 }
 
-func restoreProfiles(ctx *lxminContext, instance, backupNamePrefix string, resInfo restoreInfo) {
+// restoreProfiles - restores every profile of the backup, failures do not
+// stop the remaining profiles and are returned together.
+func restoreProfiles(ctx *lxminContext, instance, backupNamePrefix, project string, resInfo restoreInfo, verify, overwrite bool) error {
+	remote, _ := splitRemote(instance)
 	existingProfiles := set.NewStringSet()
 	retrieveExistingProfiles := func() tea.Msg {
-		p, err := fetchExistingProfiles()
+		p, err := fetchExistingProfiles(remote, project)
 		if err != nil {
 			return err
 		}
@@ -131,10 +385,14 @@ func restoreProfiles(ctx *lxminContext, instance, backupNamePrefix string, resIn
 	if err := tea.NewProgram(sUI).Start(); err != nil {
 		log.Fatalln(err)
 	}
+	if sUI.err != nil {
+		return sUI.err
+	}
 
+	var errs []error
 	for i, pf := range resInfo.profiles {
 		restoreProfile := func() tea.Msg {
-			err := restoreProfile(ctx, pf, resInfo.profileKeys[i], existingProfiles)
+			err := restoreProfile(ctx, pf, resInfo.profileKeys[i], remote, project, existingProfiles, verify, overwrite)
 			if w, ok := err.(warnMsgErr); ok {
 				return w.msg
 			} else if err != nil {
@@ -143,29 +401,73 @@ func restoreProfiles(ctx *lxminContext, instance, backupNamePrefix string, resIn
 			return true
 		}
 
+		message := `%s Created profile ` + pf + ` for: %s`
+		if overwrite && existingProfiles.Contains(pf) {
+			message = `%s Overwrote profile ` + pf + ` for: %s`
+		}
 		sUI := initCmdSpinnerUI(restoreProfile,
-			cOpts{instance: instance, message: `%s Created profile ` + pf + ` for: %s`})
+			cOpts{instance: instance, message: message})
 		if err := tea.NewProgram(sUI).Start(); err != nil {
 			log.Fatalln(err)
 		}
+		if sUI.err != nil {
+			errs = append(errs, sUI.err)
+		}
 	}
+	return errors.Join(errs...)
 }
 
-func downloadBackupFiles(ctx *lxminContext, bkp backup, resInfo restoreInfo) error {
-	bar := pb.Start64(resInfo.totalSize)
+// restoreVolumes - imports the custom storage volumes of the backup, they
+// must exist before the instance attaching them is imported.
+func restoreVolumes(ctx *lxminContext, instance, project string, resInfo restoreInfo) error {
+	remote, _ := splitRemote(instance)
+	for i, mv := range resInfo.volumes {
+		restoreVolume := func() tea.Msg {
+			err := restoreVolume(ctx, mv.volume(), resInfo.volumeKeys[i], remote, project)
+			if w, ok := err.(warnMsgErr); ok {
+				return w.msg
+			} else if err != nil {
+				return err
+			}
+			return true
+		}
+
+		sUI := initCmdSpinnerUI(restoreVolume,
+			cOpts{instance: instance, message: `%s Imported storage volume ` + mv.Pool + `/` + mv.Name + ` for: %s`})
+		if err := tea.NewProgram(sUI).Start(); err != nil {
+			log.Fatalln(err)
+		}
+		if sUI.err != nil {
+			return sUI.err
+		}
+	}
+	return nil
+}
+
+// downloadBackupFiles - downloads the backup to the staging directory,
+// with stream the instance backup is left to streamInstance.
+func downloadBackupFiles(ctx *lxminContext, bkp backup, resInfo restoreInfo, stream bool) error {
+	total := resInfo.totalSize
+	if stream {
+		total -= resInfo.instanceSize
+	}
+	bar := pb.Start64(total)
 	bar.Set(pb.Bytes, true)
 	defer bar.Finish()
 
-	// Download profiles
-	for _, pkey := range resInfo.profileKeys {
-		err := ctx.downloadItem(pkey, bar)
-		if err != nil {
-			return fmt.Errorf("Error downloading profile file %s: %v", pkey, err)
-		}
+	// Download profiles and storage volumes
+	if err := ctx.downloadProfiles(resInfo, bar, nil); err != nil {
+		return err
+	}
+	if err := ctx.downloadVolumes(resInfo, bar, nil); err != nil {
+		return err
+	}
+	if stream {
+		return nil
 	}
 
 	// Download instance backup
-	if err := ctx.downloadItem(bkp.key(), bar); err != nil {
+	if err := ctx.downloadItem(bkp.key(), bar, nil, false); err != nil {
 		return fmt.Errorf("Error downloading instance backup %s: %v", bkp.key(), err)
 	}
 	return nil
@@ -205,10 +507,11 @@ func (b *barUpdateWriter) Close() error {
 }
 
 // collectBackupInfo collects backup info so we can show a progress bar and
-// restore profiles in order.
-func collectBackupInfo(ctx *lxminContext, bkp backup) (bi restoreInfo) {
+// restore profiles in order. Errors fetching it, e.g. a backup refused by
+// --max-object-size or --strict, are returned so that nothing is downloaded.
+func collectBackupInfo(ctx *lxminContext, bkp backup, allowMissing bool) (bi restoreInfo, err error) {
 	populateRestoreInfo := func() tea.Msg {
-		ri, err := ctx.fetchRestoreInfo(bkp)
+		ri, err := ctx.fetchRestoreInfo(bkp, allowMissing)
 		if err != nil {
 			return err
 		}
@@ -224,5 +527,5 @@ func collectBackupInfo(ctx *lxminContext, bkp backup) (bi restoreInfo) {
 		log.Fatalln(err)
 	}
 
-	return bi
+	return bi, sUI.err
 }
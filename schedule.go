@@ -0,0 +1,254 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/minio/cli"
+	"github.com/robfig/cron/v3"
+)
+
+var scheduleFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cron",
+		Usage: "standard cron expression to run backups on, e.g. '0 2 * * *'",
+	},
+	cli.DurationFlag{
+		Name:  "jitter",
+		Usage: "delay each scheduled run by a random duration up to this value",
+	},
+	cli.IntFlag{
+		Name:  "keep-last",
+		Usage: "number of most recent backups to retain per instance, 0 keeps all",
+	},
+	cli.IntFlag{
+		Name:  "max-concurrent",
+		Usage: "maximum number of instances backed up at the same time, 0 for unlimited",
+	},
+}
+
+var scheduleCmd = cli.Command{
+	Name:   "schedule",
+	Usage:  "backup instances to MinIO periodically on a cron schedule",
+	Action: scheduleMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(append(scheduleFlags, backupFlags...), globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME [INSTANCENAME...]
+
+TIP:
+   Send SIGHUP to reload the global configuration without restarting.
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Backup instances 'u2' and 'u3' every night at 2AM, keeping the last 7 backups:
+     {{.Prompt}} {{.HelpName}} u2 u3 --cron "0 2 * * *" --keep-last 7
+  2. Backup an instance 'u2' every hour, spreading the start over 10 minutes:
+     {{.Prompt}} {{.HelpName}} u2 --cron "@hourly" --jitter 10m --optimized
+`,
+}
+
+func scheduleMain(c *cli.Context) error {
+	var instances []string
+	for _, arg := range c.Args() {
+		if instance := strings.TrimSpace(arg); instance != "" {
+			instances = append(instances, instance)
+		}
+	}
+	if len(instances) == 0 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+	for _, instance := range instances {
+		if err := validateNames(instance, ""); err != nil {
+			return err
+		}
+	}
+
+	if c.String("cron") == "" {
+		return fmt.Errorf("a cron expression is required, please use '--cron \"0 2 * * *\"'")
+	}
+
+	sched, err := cron.ParseStandard(c.String("cron"))
+	if err != nil {
+		return fmt.Errorf("invalid cron expression '%s': %v", c.String("cron"), err)
+	}
+
+	bopts, err := backupOptsFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	jitter := c.Duration("jitter")
+	keepLast := c.Int("keep-last")
+	state := newScheduleState(c.Int("max-concurrent"))
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	for {
+		next := sched.Next(time.Now())
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		log.Printf("Next scheduled backup for %s at %s", strings.Join(instances, ", "), next.Format(printDate))
+
+		select {
+		case <-time.After(time.Until(next)):
+			for _, instance := range instances {
+				if !state.tryStart(instance) {
+					// Previous run is still going, do not pile up.
+					log.Printf("Skipping scheduled backup of instance '%s', previous run still in progress", instance)
+					skippedAt := time.Now()
+					notifyEvent(eventInfo{
+						OpType:    Backup,
+						State:     Skipped,
+						Instance:  instance,
+						StartedAt: &skippedAt,
+					}, globalContext.NotifyEndpoint)
+					continue
+				}
+				go func(instance string) {
+					defer state.done(instance)
+					state.acquire()
+					defer state.release()
+					scheduledBackup(instance, bopts, keepLast)
+				}(instance)
+			}
+		case <-hupCh:
+			log.Println("Received SIGHUP, reloading configuration")
+			if err := setGlobalsFromContext(c); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// scheduleState - tracks instances with a scheduled backup in progress and
+// caps how many run at the same time.
+type scheduleState struct {
+	sync.Mutex
+	running map[string]struct{}
+	slots   chan struct{}
+}
+
+func newScheduleState(maxConcurrent int) *scheduleState {
+	s := &scheduleState{running: map[string]struct{}{}}
+	if maxConcurrent > 0 {
+		s.slots = make(chan struct{}, maxConcurrent)
+	}
+	return s
+}
+
+// tryStart - marks the instance as running, returns false if it already is.
+func (s *scheduleState) tryStart(instance string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.running[instance]; ok {
+		return false
+	}
+	s.running[instance] = struct{}{}
+	return true
+}
+
+func (s *scheduleState) done(instance string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.running, instance)
+}
+
+// acquire - blocks until a concurrency slot is available.
+func (s *scheduleState) acquire() {
+	if s.slots != nil {
+		s.slots <- struct{}{}
+	}
+}
+
+func (s *scheduleState) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// scheduledBackup - runs a single backup of the instance through the same
+// code path as the REST API, then applies retention.
+func scheduledBackup(instance string, bopts backupOpts, keepLast int) {
+	notifyEndpoint := globalContext.NotifyEndpoint
+	// Instances are backed up together, the instance is part of the name
+	// so that their backups and staged files do not have the same names.
+	backupName := scheduledBackupName(instance, time.Now())
+	startedAt := time.Now()
+	if err := performBackup(instance, backupName, bopts, startedAt, notifyEndpoint, ""); err != nil {
+		failedAt := time.Now()
+		notifyEvent(eventInfo{
+			OpType:    Backup,
+			State:     Failed,
+			Name:      backupName,
+			Instance:  instance,
+			StartedAt: &startedAt,
+			FailedAt:  &failedAt,
+			Error:     err,
+		}, notifyEndpoint)
+		log.Printf("Scheduled backup of instance '%s' failed: %v", instance, err)
+		return
+	}
+	log.Printf("Scheduled backup '%s' of instance '%s' completed", backupName, instance)
+
+	if keepLast > 0 {
+		if err := pruneBackups(instance, keepLast); err != nil {
+			log.Printf("Unable to apply retention for instance '%s': %v", instance, err)
+		}
+	}
+}
+
+// scheduledBackupName - name of a scheduled backup of the instance.
+func scheduledBackupName(instance string, t time.Time) string {
+	return "backup_" + instance + "_" + t.Format("2006-01-02-15-0405")
+}
+
+// pruneBackups - deletes all but the keepLast most recent backups of the
+// instance.
+func pruneBackups(instance string, keepLast int) error {
+	backups, err := globalContext.ListBackups(instance)
+	if err != nil {
+		return err
+	}
+
+	for _, bkp := range backupsToPrune(backups, keepLast, 0, time.Now()) {
+		if _, err := globalContext.DeleteBackup(backup{instance: instance, backupName: bkp.Name}); err != nil {
+			return err
+		}
+		log.Printf("Deleted backup '%s' of instance '%s' per retention policy", bkp.Name, instance)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduleStateTryStart(t *testing.T) {
+	s := newScheduleState(0)
+	if !s.tryStart("u1") {
+		t.Fatal("expected the first run of u1 to start")
+	}
+	// Skipped while the previous run of the instance is in progress,
+	// other instances are not affected.
+	if s.tryStart("u1") {
+		t.Fatal("expected the run of u1 to be skipped while running")
+	}
+	if !s.tryStart("u2") {
+		t.Fatal("expected the run of u2 to start")
+	}
+	s.done("u1")
+	if !s.tryStart("u1") {
+		t.Fatal("expected u1 to start once the previous run is done")
+	}
+}
+
+func TestScheduleStateMaxConcurrent(t *testing.T) {
+	for _, maxConcurrent := range []int{1, 2, 3} {
+		s := newScheduleState(maxConcurrent)
+		var running, peak atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.acquire()
+				defer s.release()
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				running.Add(-1)
+			}()
+		}
+		wg.Wait()
+		if p := peak.Load(); p > int32(maxConcurrent) {
+			t.Errorf("--max-concurrent %d: expected at most %d backups at once, got %d", maxConcurrent, maxConcurrent, p)
+		}
+	}
+
+	// Unlimited never blocks.
+	s := newScheduleState(0)
+	for i := 0; i < 100; i++ {
+		s.acquire()
+	}
+}
+
+func TestScheduledBackupName(t *testing.T) {
+	newTestContext(t)
+	fakeLXC(t, "exit 1\n")
+	prev := globalEvents
+	events := &eventLog{}
+	globalEvents = events
+	t.Cleanup(func() { globalEvents = prev })
+
+	// Instances of a run are backed up at the same time.
+	var wg sync.WaitGroup
+	for _, instance := range []string{"u1", "u2"} {
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			scheduledBackup(instance, backupOpts{}, 0)
+		}(instance)
+	}
+	wg.Wait()
+
+	names := map[string]string{}
+	for _, raw := range events.list() {
+		var e struct {
+			State, Name, Instance string
+		}
+		json.Unmarshal(raw, &e)
+		if e.State != Failed {
+			continue
+		}
+		if !strings.HasPrefix(e.Name, "backup_"+e.Instance+"_") {
+			t.Errorf("expected the name of the backup of %s to include it, got %s", e.Instance, e.Name)
+		}
+		names[e.Instance] = e.Name
+	}
+	if len(names) != 2 || names["u1"] == names["u2"] {
+		t.Fatalf("expected a failed backup with its own name per instance, got %v", names)
+	}
+	if n := globalBackupState.Len(); n != 0 {
+		t.Fatalf("expected no backups in progress, got %d", n)
+	}
+}
+
+func TestPruneBackupsRetention(t *testing.T) {
+	ms := newTestContext(t)
+	for _, name := range []string{"b1", "b2", "b3"} {
+		putTestBackup(t, ms, testBackup{instance: "u1", name: name, profiles: []string{"default"}})
+	}
+	putTestBackup(t, ms, testBackup{instance: "u2", name: "b1"})
+
+	if err := pruneBackups("u1", 1); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"u1/b3_instance.tar.gz",
+		"u1/b3_manifest.json",
+		"u1/b3_profile_000_default.yaml",
+		"u2/b1_instance.tar.gz",
+		"u2/b1_manifest.json",
+	}
+	if got := ms.keys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
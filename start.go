@@ -0,0 +1,80 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/minio/cli"
+)
+
+var startCmd = cli.Command{
+	Name:   "start",
+	Usage:  "start instances restored with '--import-stopped'",
+	Action: startMain,
+	Before: func(c *cli.Context) error {
+		// Only lxc is needed to start instances, not MinIO.
+		if _, err := applyConfig(c); err != nil {
+			return err
+		}
+		return setLXCOptions(c)
+	},
+	Flags: globalFlags,
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME [INSTANCENAME...]
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Start instances 'u2' and 'u3' staged with 'restore --import-stopped':
+     {{.Prompt}} {{.HelpName}} u2 u3
+`,
+}
+
+func startMain(c *cli.Context) error {
+	if !c.Args().Present() {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	for _, arg := range c.Args() {
+		instance := strings.TrimSpace(arg)
+		if instance == "" {
+			continue
+		}
+
+		startFn := func() tea.Msg {
+			if outBuf, err := startInstance(instance, ""); err != nil {
+				return fmt.Errorf("%v\n%s", err, outBuf.String())
+			}
+			return true
+		}
+
+		sUI := initCmdSpinnerUI(startFn, cOpts{instance: instance, message: `%s Starting instance: %s`})
+		if err := tea.NewProgram(sUI).Start(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// BackupStore - object storage operations lxmin needs for backups, keys
+// are relative to the configured bucket.
+type BackupStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, opts minio.PutObjectOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, minio.ObjectInfo, error)
+	Stat(ctx context.Context, key string) (minio.ObjectInfo, error)
+	List(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	Delete(ctx context.Context, key string, opts minio.RemoveObjectOptions) error
+	Tags(ctx context.Context, key string) (*tags.Tags, error)
+	ReplaceMetadata(ctx context.Context, key string, metadata map[string]string) error
+	BucketExists(ctx context.Context) (bool, error)
+}
+
+// minioStore - BackupStore implemented over minio-go. When sse is set all
+// objects are written and read with it.
+type minioStore struct {
+	clnt   *minio.Client
+	bucket string
+	sse    encrypt.ServerSide
+}
+
+func newMinioStore(clnt *minio.Client, bucket string, sse encrypt.ServerSide) *minioStore {
+	return &minioStore{clnt: clnt, bucket: bucket, sse: sse}
+}
+
+// withEncryptionMarker - adds the non-secret `encrypted` marker to the
+// metadata of encrypted objects, so it can be shown without the key.
+func (s *minioStore) withEncryptionMarker(metadata map[string]string) map[string]string {
+	if s.sse == nil {
+		return metadata
+	}
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m["encrypted"] = string(s.sse.Type())
+	return m
+}
+
+// readSSE - returns the encryption to send when reading objects, only
+// SSE-C needs the key again.
+func (s *minioStore) readSSE() encrypt.ServerSide {
+	if s.sse != nil && s.sse.Type() == encrypt.SSEC {
+		return s.sse
+	}
+	return nil
+}
+
+func (s *minioStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts minio.PutObjectOptions) error {
+	opts.ServerSideEncryption = s.sse
+	opts.UserMetadata = s.withEncryptionMarker(opts.UserMetadata)
+	_, err := s.clnt.PutObject(ctx, s.bucket, key, r, size, opts)
+	return err
+}
+
+// Get - the returned info is from the GET response, so no separate
+// stat is made for it.
+func (s *minioStore) Get(ctx context.Context, key string) (io.ReadCloser, minio.ObjectInfo, error) {
+	obj, err := s.clnt.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{ServerSideEncryption: s.readSSE()})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	oi, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, oi, err
+	}
+	return obj, oi, nil
+}
+
+func (s *minioStore) Stat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	return s.clnt.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{ServerSideEncryption: s.readSSE()})
+}
+
+func (s *minioStore) List(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	return s.clnt.ListObjects(ctx, s.bucket, opts)
+}
+
+func (s *minioStore) Delete(ctx context.Context, key string, opts minio.RemoveObjectOptions) error {
+	return s.clnt.RemoveObject(ctx, s.bucket, key, opts)
+}
+
+func (s *minioStore) Tags(ctx context.Context, key string) (*tags.Tags, error) {
+	return s.clnt.GetObjectTagging(ctx, s.bucket, key, minio.GetObjectTaggingOptions{})
+}
+
+// ReplaceMetadata - rewrites the object onto itself with new metadata,
+// compose handles copying objects larger than 5GiB in place. The storage
+// class, tags and object lock of the object are kept, a copy would drop
+// them otherwise.
+func (s *minioStore) ReplaceMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	oi, err := s.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	metadata = s.withEncryptionMarker(metadata)
+	if oi.StorageClass != "" {
+		m := make(map[string]string, len(metadata)+1)
+		for k, v := range metadata {
+			m[k] = v
+		}
+		m["X-Amz-Storage-Class"] = oi.StorageClass
+		metadata = m
+	}
+	dst := minio.CopyDestOptions{
+		Bucket:          s.bucket,
+		Object:          key,
+		Encryption:      s.sse,
+		UserMetadata:    metadata,
+		ReplaceMetadata: true,
+		ReplaceTags:     true,
+	}
+	if oi.UserTagCount > 0 {
+		t, err := s.Tags(ctx, key)
+		if err != nil {
+			return err
+		}
+		dst.UserTags = t.ToMap()
+	}
+	lock := objectLockFromHeader(oi.Metadata)
+	if lock.RetainUntil != nil {
+		dst.Mode = minio.RetentionMode(lock.Mode)
+		dst.RetainUntilDate = *lock.RetainUntil
+	}
+	if lock.LegalHold {
+		dst.LegalHold = minio.LegalHoldEnabled
+	}
+	_, err = s.clnt.ComposeObject(ctx, dst, minio.CopySrcOptions{
+		Bucket:     s.bucket,
+		Object:     key,
+		Encryption: s.readSSE(),
+	})
+	return err
+}
+
+func (s *minioStore) BucketExists(ctx context.Context) (bool, error) {
+	return s.clnt.BucketExists(ctx, s.bucket)
+}
+
+// failoverStore - BackupStore over the stores of several endpoints, in
+// order of preference. An operation that can not connect to an endpoint
+// is sent to the next one, it fails when no endpoint is reachable. Every
+// operation starts with the preferred endpoint again.
+type failoverStore struct {
+	stores []BackupStore
+}
+
+// isConnErr - reports errors connecting to an endpoint, the request never
+// reached it and can be sent to another endpoint.
+func isConnErr(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+func (s *failoverStore) try(fn func(store BackupStore) error) (err error) {
+	for _, store := range s.stores {
+		if err = fn(store); !isConnErr(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Put - r is rewound before sending it to the next endpoint, a reader
+// that can not seek is only sent to the preferred endpoint.
+func (s *failoverStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts minio.PutObjectOptions) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return s.stores[0].Put(ctx, key, r, size, opts)
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return s.stores[0].Put(ctx, key, r, size, opts)
+	}
+	return s.try(func(store BackupStore) error {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		return store.Put(ctx, key, r, size, opts)
+	})
+}
+
+func (s *failoverStore) Get(ctx context.Context, key string) (rc io.ReadCloser, oi minio.ObjectInfo, err error) {
+	err = s.try(func(store BackupStore) error {
+		rc, oi, err = store.Get(ctx, key)
+		return err
+	})
+	return rc, oi, err
+}
+
+func (s *failoverStore) Stat(ctx context.Context, key string) (oi minio.ObjectInfo, err error) {
+	err = s.try(func(store BackupStore) error {
+		oi, err = store.Stat(ctx, key)
+		return err
+	})
+	return oi, err
+}
+
+// List - a listing is sent to the next endpoint only when its first
+// result is a connection error.
+func (s *failoverStore) List(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	out := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(out)
+		for i, store := range s.stores {
+			ch := store.List(ctx, opts)
+			first, ok := <-ch
+			if !ok {
+				return
+			}
+			if isConnErr(first.Err) && i < len(s.stores)-1 {
+				for range ch {
+				}
+				continue
+			}
+			for obj := first; ok; obj, ok = <-ch {
+				select {
+				case out <- obj:
+				case <-ctx.Done():
+					return
+				}
+			}
+			return
+		}
+	}()
+	return out
+}
+
+func (s *failoverStore) Delete(ctx context.Context, key string, opts minio.RemoveObjectOptions) error {
+	return s.try(func(store BackupStore) error {
+		return store.Delete(ctx, key, opts)
+	})
+}
+
+func (s *failoverStore) Tags(ctx context.Context, key string) (t *tags.Tags, err error) {
+	err = s.try(func(store BackupStore) error {
+		t, err = store.Tags(ctx, key)
+		return err
+	})
+	return t, err
+}
+
+func (s *failoverStore) ReplaceMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	return s.try(func(store BackupStore) error {
+		return store.ReplaceMetadata(ctx, key, metadata)
+	})
+}
+
+func (s *failoverStore) BucketExists(ctx context.Context) (exists bool, err error) {
+	err = s.try(func(store BackupStore) error {
+		exists, err = store.BucketExists(ctx)
+		return err
+	})
+	return exists, err
+}
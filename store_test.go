@@ -0,0 +1,405 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// memObject - an object of the memStore.
+type memObject struct {
+	data []byte
+	info minio.ObjectInfo
+}
+
+// memStore - in-memory BackupStore for tests, objects are listed in key
+// order and each upload is one second newer than the previous one.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string]*memObject
+	clock   time.Time
+	copies  int // objects copied onto themselves by ReplaceMetadata
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		objects: map[string]*memObject{},
+		clock:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// objectHeaders - metadata keys sent as standard headers instead of user
+// metadata, as minio-go does.
+var objectHeaders = []string{"Content-Type", "Content-Disposition", "Content-Encoding", "Cache-Control"}
+
+// setMetadata - saves metadata the way a stat returns it, user metadata
+// keys are canonicalized and without the `X-Amz-Meta-` prefix.
+func (obj *memObject) setMetadata(metadata map[string]string) {
+	obj.info.UserMetadata = minio.StringMap{}
+	for _, h := range objectHeaders {
+		obj.info.Metadata.Del(h)
+	}
+	for k, v := range metadata {
+		k = http.CanonicalHeaderKey(k)
+		if slices.Contains(objectHeaders, k) {
+			obj.info.Metadata.Set(k, v)
+			continue
+		}
+		obj.info.UserMetadata[k] = v
+	}
+}
+
+func errNoSuchKey(key string) error {
+	return minio.ErrorResponse{Code: "NoSuchKey", Key: key, Message: "The specified key does not exist.", StatusCode: http.StatusNotFound}
+}
+
+func (s *memStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts minio.PutObjectOptions) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = s.clock.Add(time.Second)
+	obj := &memObject{
+		data: data,
+		info: minio.ObjectInfo{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: s.clock,
+			Metadata:     http.Header{},
+			UserTags:     opts.UserTags,
+			StorageClass: opts.StorageClass,
+		},
+	}
+	obj.setMetadata(opts.UserMetadata)
+	if opts.ContentType != "" {
+		obj.info.Metadata.Set("Content-Type", opts.ContentType)
+	}
+	if opts.ContentEncoding != "" {
+		obj.info.Metadata.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	if opts.ContentDisposition != "" {
+		obj.info.Metadata.Set("Content-Disposition", opts.ContentDisposition)
+	}
+	s.objects[key] = obj
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, key string) (io.ReadCloser, minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, minio.ObjectInfo{}, errNoSuchKey(key)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), obj.info, nil
+}
+
+func (s *memStore) Stat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return minio.ObjectInfo{}, errNoSuchKey(key)
+	}
+	return obj.info, nil
+}
+
+// List - user metadata is listed with the `X-Amz-Meta-` prefix, as in a
+// listing with metadata.
+func (s *memStore) List(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	s.mu.Lock()
+	var infos []minio.ObjectInfo
+	prefixes := map[string]bool{}
+	for key, obj := range s.objects {
+		if !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+		if !opts.Recursive {
+			if i := strings.Index(key[len(opts.Prefix):], "/"); i >= 0 {
+				prefix := key[:len(opts.Prefix)+i+1]
+				if !prefixes[prefix] {
+					prefixes[prefix] = true
+					infos = append(infos, minio.ObjectInfo{Key: prefix})
+				}
+				continue
+			}
+		}
+		info := obj.info
+		info.UserMetadata = nil
+		if opts.WithMetadata {
+			info.UserMetadata = minio.StringMap{}
+			for k, v := range obj.info.UserMetadata {
+				info.UserMetadata["X-Amz-Meta-"+k] = v
+			}
+		}
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	ch := make(chan minio.ObjectInfo, len(infos))
+	for _, info := range infos {
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+func (s *memStore) Delete(ctx context.Context, key string, opts minio.RemoveObjectOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStore) Tags(ctx context.Context, key string) (*tags.Tags, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, errNoSuchKey(key)
+	}
+	return tags.NewTags(obj.info.UserTags, true)
+}
+
+func (s *memStore) ReplaceMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return errNoSuchKey(key)
+	}
+	obj.setMetadata(metadata)
+	s.copies++
+	return nil
+}
+
+func (s *memStore) BucketExists(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// keys - returns the keys of all objects in order.
+func (s *memStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// testToken - REST API bearer token of the test context.
+const testToken = "lxmin-test-token"
+
+// newTestContext - points globalContext at a new memStore for the
+// duration of the test.
+func newTestContext(t *testing.T) *memStore {
+	t.Helper()
+	ms := newMemStore()
+	prev := globalContext
+	globalContext = &lxminContext{
+		Store:       ms,
+		Bucket:      "backups",
+		StagingRoot: t.TempDir(),
+		APIToken:    testToken,
+	}
+	t.Cleanup(func() { globalContext = prev })
+	return ms
+}
+
+// testBackup - a backup uploaded to a memStore by putTestBackup.
+type testBackup struct {
+	instance, name string
+	profiles       []string
+	data           string // contents of the instance tarball
+	bopts          backupOpts
+}
+
+// putTestBackup - uploads the instance tarball, profiles and manifest of
+// the backup the way `lxmin backup` lays them out.
+func putTestBackup(t *testing.T, ms *memStore, tb testBackup) backup {
+	t.Helper()
+	if tb.bopts.TagsSet == nil {
+		tb.bopts.TagsSet, _ = tags.NewTags(nil, true)
+	}
+	if tb.data == "" {
+		tb.data = "instance " + tb.name
+	}
+	ctx := context.Background()
+	bkp := tb.bopts.newBackup(tb.instance, tb.name)
+
+	var m backupManifest
+	for i, profile := range tb.profiles {
+		data := []byte("name: " + profile + "\n")
+		object := profileBackupName(tb.name, i, profile)
+		if err := ms.Put(ctx, path.Join(tb.instance, object), bytes.NewReader(data), int64(len(data)), tb.bopts.profilePutOptions()); err != nil {
+			t.Fatal(err)
+		}
+		m.Profiles = append(m.Profiles, manifestProfile{
+			Name:   profile,
+			Index:  i,
+			Object: object,
+			Size:   int64(len(data)),
+			SHA256: sha256Hex(data),
+		})
+	}
+	if err := globalContext.putManifest(bkp, tb.bopts, m); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := tb.bopts.withObjectOptions(minio.PutObjectOptions{
+		UserTags:     tb.bopts.TagsSet.ToMap(),
+		UserMetadata: tb.bopts.instanceMetadata(sha256Hex([]byte(tb.data))),
+	})
+	if err := ms.Put(ctx, bkp.key(), strings.NewReader(tb.data), int64(len(tb.data)), opts); err != nil {
+		t.Fatal(err)
+	}
+	return bkp
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIsConnErr(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&url.Error{Op: "Head", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&net.DNSError{Name: "minio.invalid", IsNotFound: true}, true},
+		// The request may have reached the endpoint.
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		{minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound}, false},
+		{minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}, false},
+	}
+	for _, tc := range testCases {
+		if got := isConnErr(tc.err); got != tc.want {
+			t.Errorf("%v: expected %t, got %t", tc.err, tc.want, got)
+		}
+	}
+}
+
+// s3Server - serves HEAD object requests with status, counting them.
+type s3Server struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newS3Server(t *testing.T, status int) *s3Server {
+	t.Helper()
+	s := &s3Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if status == http.StatusOK {
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+			w.Header().Set("Content-Length", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestMinioStore - minioStore of the server at rawURL.
+func newTestMinioStore(t *testing.T, rawURL string) BackupStore {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clnt, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4("minioadmin", "minioadmin", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMinioStore(clnt, "backups", nil)
+}
+
+func TestFailoverStore(t *testing.T) {
+	prev := minio.MaxRetry
+	minio.MaxRetry = 1
+	t.Cleanup(func() { minio.MaxRetry = prev })
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	testCases := []struct {
+		name     string
+		status   int // of the preferred endpoint, 0 when it is down
+		wantErr  bool
+		failover bool
+	}{
+		{"endpoint down", 0, false, true},
+		{"success", http.StatusOK, false, false},
+		{"not found", http.StatusNotFound, true, false},
+		{"forbidden", http.StatusForbidden, true, false},
+		{"server error", http.StatusInternalServerError, true, false},
+	}
+	for _, tc := range testCases {
+		next := newS3Server(t, http.StatusOK)
+		preferred := closed.URL
+		if tc.status != 0 {
+			preferred = newS3Server(t, tc.status).URL
+		}
+		s := &failoverStore{stores: []BackupStore{
+			newTestMinioStore(t, preferred),
+			newTestMinioStore(t, next.URL),
+		}}
+
+		_, err := s.Stat(context.Background(), "u1/b1_instance.tar.gz")
+		if tc.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %t, got %v", tc.name, tc.wantErr, err)
+		}
+		if failover := next.requests.Load() > 0; failover != tc.failover {
+			t.Errorf("%s: expected failover %t, got %t", tc.name, tc.failover, failover)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/minio/cli"
+)
+
+var tagsFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the tag keys, values and counts as JSON",
+	},
+	cli.IntFlag{
+		Name:  "concurrency",
+		Value: defaultTagsConcurrency,
+		Usage: "number of backups whose tags are fetched in parallel",
+	},
+}
+
+var tagsCmd = cli.Command{
+	Name:   "tags",
+	Usage:  "list the tag keys and values used across backups, with counts",
+	Action: tagsMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(tagsFlags, globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] [INSTANCENAME]
+
+TIP:
+   Without INSTANCENAME, or with '*', the tags of all backups in the bucket are listed.
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. List the tags used by all backups in the bucket:
+     {{.Prompt}} {{.HelpName}}
+  2. List the tags used by the backups of instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2
+  3. List the tags used by all backups as JSON:
+     {{.Prompt}} {{.HelpName}} --json
+`,
+}
+
+// defaultTagsConcurrency - backups whose tags are fetched in parallel.
+const defaultTagsConcurrency = 8
+
+// tagValueCount - number of backups tagged with a value of a tag key.
+type tagValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// tagKeyCount - a tag key, the number of backups tagged with it and its
+// distinct values.
+type tagKeyCount struct {
+	Key    string          `json:"key"`
+	Count  int             `json:"count"`
+	Values []tagValueCount `json:"values"`
+}
+
+// tagsCache - tags of backups by object key, fetched at most once per
+// run.
+type tagsCache struct {
+	mu   sync.Mutex
+	tags map[string]map[string]string
+}
+
+// get - returns the tags of the backup, the tags returned by the listing
+// are used when present.
+func (tc *tagsCache) get(l *lxminContext, bkp backupInfo) (map[string]string, error) {
+	if len(bkp.Tags) > 0 {
+		return bkp.Tags, nil
+	}
+
+	tc.mu.Lock()
+	t, ok := tc.tags[bkp.Key]
+	tc.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	b := backup{instance: bkp.Instance, backupName: bkp.Name, uncompressed: strings.HasSuffix(bkp.Key, plainInstanceSuffix)}
+	tt, err := l.GetTags(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get tags of backup %s: %v", bkp.Name, err)
+	}
+	t = tt.ToMap()
+
+	tc.mu.Lock()
+	tc.tags[bkp.Key] = t
+	tc.mu.Unlock()
+	return t, nil
+}
+
+// countTags - aggregates the tags of the backups into their distinct keys
+// and values with counts, sorted by key and value.
+func countTags(backupTags []map[string]string) []tagKeyCount {
+	keys := map[string]int{}
+	values := map[string]map[string]int{}
+	for _, t := range backupTags {
+		for k, v := range t {
+			keys[k]++
+			if values[k] == nil {
+				values[k] = map[string]int{}
+			}
+			values[k][v]++
+		}
+	}
+
+	counts := make([]tagKeyCount, 0, len(keys))
+	for k, n := range keys {
+		kc := tagKeyCount{Key: k, Count: n}
+		for v, vn := range values[k] {
+			kc.Values = append(kc.Values, tagValueCount{Value: v, Count: vn})
+		}
+		sort.Slice(kc.Values, func(i, j int) bool { return kc.Values[i].Value < kc.Values[j].Value })
+		counts = append(counts, kc)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Key < counts[j].Key })
+	return counts
+}
+
+// fetchTags - fetches the tags of the backups, concurrency at a time.
+func (l *lxminContext) fetchTags(backups []backupInfo, concurrency int) ([]map[string]string, error) {
+	if concurrency < 1 {
+		concurrency = defaultTagsConcurrency
+	}
+
+	cache := &tagsCache{tags: map[string]map[string]string{}}
+	backupTags := make([]map[string]string, len(backups))
+	errs := make([]error, len(backups))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range backups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			backupTags[i], errs[i] = cache.get(l, backups[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return backupTags, nil
+}
+
+func tagsMain(c *cli.Context) error {
+	if len(c.Args()) > 1 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	// Allow '*' for all backups, same as list.
+	if instance == "*" {
+		instance = ""
+	}
+	if err := validateNames(instance, ""); err != nil {
+		return err
+	}
+
+	backups, err := globalContext.ListBackups(instance)
+	if err != nil {
+		return err
+	}
+
+	backupTags, err := globalContext.fetchTags(backups, c.Int("concurrency"))
+	if err != nil {
+		return err
+	}
+	counts := countTags(backupTags)
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(counts)
+	}
+
+	if len(counts) == 0 {
+		fmt.Printf("No tags found on %d backups\n", len(backups))
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tBACKUPS")
+	for _, kc := range counts {
+		fmt.Fprintf(tw, "%s\t\t%d\n", kc.Key, kc.Count)
+		for _, vc := range kc.Values {
+			fmt.Fprintf(tw, "\t%s\t%d\n", vc.Value, vc.Count)
+		}
+	}
+	return tw.Flush()
+}
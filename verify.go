@@ -0,0 +1,169 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/minio/cli"
+)
+
+var verifyFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "keep-going",
+		Usage: "verify all backups with '*' instead of stopping at the first failure",
+	},
+}
+
+var verifyCmd = cli.Command{
+	Name:   "verify",
+	Usage:  "verify backups on MinIO against the checksum stored at backup",
+	Action: verifyMain,
+	Before: setGlobalsFromContext,
+	Flags:  append(verifyFlags, globalFlags...),
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} [FLAGS] INSTANCENAME BACKUPNAME
+
+TIP:
+   Use '*' as BACKUPNAME to verify all backups of the instance.
+
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}
+EXAMPLES:
+  1. Verify backup 'backup_2022-02-16-04-1040' for instance 'u2':
+     {{.Prompt}} {{.HelpName}} u2 backup_2022-02-16-04-1040
+  2. Verify all backups for instance 'u2', stopping at the first failure:
+     {{.Prompt}} {{.HelpName}} u2 '*'
+  3. Verify all backups for instance 'u2' and report every failure:
+     {{.Prompt}} {{.HelpName}} --keep-going u2 '*'
+`,
+}
+
+// errNoChecksum - backups made before checksums were stored can not be
+// verified.
+var errNoChecksum = errors.New("no checksum stored, the backup was made before checksums were introduced")
+
+func verifyMain(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	instance := strings.TrimSpace(c.Args().Get(0))
+	if instance == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if instance == "*" {
+		return errWildcardInstance
+	}
+
+	backupName := strings.TrimSpace(c.Args().Get(1))
+	if backupName == "" {
+		cli.ShowAppHelpAndExit(c, 1) // last argument is exit code
+	}
+
+	if backupName != "*" {
+		if err := validateNames(instance, backupName); err != nil {
+			return err
+		}
+		if err := globalContext.verifyBackup(globalContext.resolveBackup(backup{instance: instance, backupName: backupName})); err != nil {
+			return err
+		}
+		fmt.Printf("Backup %s is intact\n", backupName)
+		return nil
+	}
+
+	if err := validateNames(instance, ""); err != nil {
+		return err
+	}
+	backups, err := globalContext.ListBackups(instance)
+	if err != nil {
+		return err
+	}
+
+	// Stop at the first failed backup unless asked to verify all of
+	// them and report every failure.
+	keepGoing := c.Bool("keep-going")
+	var passed, failed, skipped int
+	for _, b := range backups {
+		err := globalContext.verifyBackup(backup{instance: instance, backupName: b.Name, uncompressed: strings.HasSuffix(b.Key, plainInstanceSuffix)})
+		switch {
+		case err == nil:
+			fmt.Printf("Backup %s is intact\n", b.Name)
+			passed++
+		case errors.Is(err, errNoChecksum):
+			fmt.Printf("Skipping backup %s: %v\n", b.Name, err)
+			skipped++
+		case !keepGoing:
+			return err
+		default:
+			fmt.Println(err)
+			failed++
+		}
+	}
+	if keepGoing {
+		fmt.Printf("Verified %d backups of instance %s: %d passed, %d failed, %d skipped\n", len(backups), instance, passed, failed, skipped)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backups of instance %s failed verification", failed, len(backups), instance)
+	}
+	return nil
+}
+
+// verifyBackup - downloads the instance backup and compares its SHA-256
+// checksum with the one stored when it was uploaded.
+func (l *lxminContext) verifyBackup(bkp backup) error {
+	meta, err := l.GetMetadata(bkp)
+	if err != nil {
+		return err
+	}
+	if meta.SHA256 == "" {
+		return fmt.Errorf("Unable to verify backup %s: %w", bkp.backupName, errNoChecksum)
+	}
+
+	obj, oi, err := l.Store.Get(context.Background(), bkp.key())
+	if err != nil {
+		return fmt.Errorf("Unable to download backup %s: %v", bkp.backupName, err)
+	}
+	defer obj.Close()
+
+	bar := pb.Start64(oi.Size)
+	bar.Set(pb.Bytes, true)
+	defer bar.Finish()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, bar.NewProxyReader(obj)); err != nil {
+		return fmt.Errorf("Unable to download backup %s: %v", bkp.backupName, err)
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != meta.SHA256 {
+		return fmt.Errorf("Backup %s is corrupted: checksum mismatch, expected %s, got %s", bkp.backupName, meta.SHA256, sum)
+	}
+	return nil
+}
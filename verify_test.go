@@ -0,0 +1,72 @@
+// Copyright (c) 2015-2022 MinIO, Inc.
+//
+// This project is part of MinIO Object Storage stack
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// corruptBackup - replaces the instance tarball of a backup, keeping its
+// stored checksum.
+func corruptBackup(ms *memStore, bkp backup) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.objects[bkp.key()].data = []byte("corrupt")
+}
+
+func TestVerifyKeepGoing(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+	corruptBackup(ms, putTestBackup(t, ms, testBackup{instance: "u1", name: "b2"}))
+	corruptBackup(ms, putTestBackup(t, ms, testBackup{instance: "u1", name: "b3"}))
+	putLegacyBackup(t, ms, "u1", "b4")
+
+	// Stops at the first corrupted backup, backups are listed newest
+	// first.
+	err := runCommand(t, verifyCmd, "u1", "*")
+	if err == nil || !strings.HasPrefix(err.Error(), "Backup b3 is corrupted") {
+		t.Fatalf("expected b3 to fail verification, got %v", err)
+	}
+
+	// Verifies all backups, the legacy one without checksum is skipped.
+	err = runCommand(t, verifyCmd, "--keep-going", "u1", "*")
+	if err == nil || err.Error() != "2 of 4 backups of instance u1 failed verification" {
+		t.Fatalf("expected 2 failed backups, got %v", err)
+	}
+
+	// A single backup is verified regardless of the others.
+	if err := runCommand(t, verifyCmd, "u1", "b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(t, verifyCmd, "--keep-going", "u1", "b3"); err == nil {
+		t.Fatal("expected b3 to fail verification")
+	}
+}
+
+func TestVerifyIntact(t *testing.T) {
+	ms := newTestContext(t)
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b1"})
+	putTestBackup(t, ms, testBackup{instance: "u1", name: "b2"})
+
+	for _, args := range [][]string{{"u1", "*"}, {"--keep-going", "u1", "*"}} {
+		if err := runCommand(t, verifyCmd, args...); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}